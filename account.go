@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/randallsquared/go-tigertonic"
+	"github.com/randallsquared/gochute/profile"
+)
+
+// ExportHandler sends the context Profile everything we hold about it, as a zip archive.
+type ExportHandler struct {
+}
+
+// Deletion is the response to asking for the context Profile to be deleted.
+type Deletion struct {
+	DeleteAfter time.Time
+}
+
+// ExportHandler.ServeHTTP gathers the Export before sending anything, so that database
+// failures get an error status.  Once the archive has started, a failure fetching a
+// Photo can only cut it short.
+func (eh ExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := tigertonic.Context(r).(*Context)
+	e, err := c.Profile.Export(c.Ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeComplaint(w, r, 504, "that took too long; please try again", err)
+		return
+	} else if errors.Is(err, context.Canceled) {
+		writeComplaint(w, r, 503, "request cancelled", err)
+		return
+	} else if err != nil {
+		writeError(w, r, 500, CodeInternal, "something went wrong on our end", fmt.Errorf("db failure: e30: %w", err))
+		return
+	}
+	record(r.Header, &c.Profile.Id, profile.EventExported, nil)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="chute-export.zip"`)
+	w.WriteHeader(http.StatusOK)
+	err = e.WriteZip(c.Ctx, w)
+	if err != nil {
+		logger(r.Header).Warn("export cut short", "profile", c.Profile.Id, "error", err)
+	}
+}
+
+// deleteProfile schedules the context Profile to be purged once profile.DeletionGrace has
+// passed.  Until then, everything keeps working, and cancelDeletion can undo it.
+func deleteProfile(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	if c.Profile.DeleteAfter != nil {
+		return http.StatusAccepted, nil, Deletion{*c.Profile.DeleteAfter}, nil
+	}
+	err := c.Profile.RequestDeletion(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: e51", err)
+	}
+	record(h, &c.Profile.Id, profile.EventDeletionRequested, profile.Details{"deleteAfter": c.Profile.DeleteAfter})
+	return http.StatusAccepted, nil, Deletion{*c.Profile.DeleteAfter}, nil
+}
+
+func cancelDeletion(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	err := c.Profile.CancelDeletion(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: e59", err)
+	}
+	record(h, &c.Profile.Id, profile.EventDeletionCancelled, nil)
+	return getProfile(u, h, nil, c)
+}
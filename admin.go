@@ -0,0 +1,413 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/randallsquared/gochute/profile"
+)
+
+// LookupChange creates or changes a Flag, Utype or RateType.  Only the fields present
+// are changed; Comm only applies to RateTypes.  Retired entries stay attached to any
+// Profiles and Freetimes that have them, but aren't offered to clients anymore.
+type LookupChange struct {
+	Name    *string
+	Comm    *string
+	Retired *bool
+}
+
+// RoleChange replaces every Role of a Profile.
+type RoleChange struct {
+	Roles profile.Roles
+}
+
+func setRoles(u *url.URL, h http.Header, r *RoleChange, c *Context) (int, http.Header, Response, error) {
+	if r == nil {
+		return error400(h, "no roles provided")
+	}
+	ip, errType, err := findProfile(u, c)
+	if err != nil {
+		return errType(h, "profile not found", err.Error())
+	}
+	if ip.Id == c.Profile.Id && !r.Roles.Has(profile.RoleAdmin) {
+		return error400(h, "you can't take away your own admin role", "admin demoting self")
+	}
+	err = ip.SetRoles(c.Ctx, r.Roles)
+	if err != nil {
+		if errors.Is(err, profile.ErrUnknownRole) {
+			return errorField(h, "Roles", "roles must be among: admin, moderator", err.Error())
+		}
+		return error500(h, "db failure: a52", err)
+	}
+	record(h, &ip.Id, profile.EventRolesChanged, profile.Details{"roles": ip.Roles, "by": c.Profile.Id})
+	return http.StatusOK, nil, RoleChange{ip.Roles}, nil
+}
+
+// lookupId returns the {id} from the URL, or a complaint about it.
+func lookupId(u *url.URL, kind string) (int, string) {
+	id := param(u, "id")
+	intId, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, "'" + id + "' is not a valid " + kind + " id."
+	}
+	return intId, ""
+}
+
+// lookupName checks that a LookupChange has a usable Name, if it has one at all.
+func lookupName(l *LookupChange, required bool) string {
+	if l == nil {
+		return "no change provided"
+	}
+	if l.Name == nil {
+		if required {
+			return "a name is required"
+		}
+		return ""
+	}
+	*l.Name = strings.TrimSpace(*l.Name)
+	if *l.Name == "" || len(*l.Name) > 127 {
+		return "names must be between 1 and 127 characters"
+	}
+	return ""
+}
+
+func getAllFlags(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	flags, err := profile.AllFlags(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: a60", err)
+	}
+	return http.StatusOK, nil, flags, nil
+}
+
+func createFlag(u *url.URL, h http.Header, l *LookupChange, c *Context) (int, http.Header, Response, error) {
+	if complaint := lookupName(l, true); complaint != "" {
+		return error400(h, complaint, "bad flag")
+	}
+	f := profile.Flag{Name: *l.Name}
+	if l.Retired != nil {
+		f.Retired = *l.Retired
+	}
+	err := f.Create(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: a75", err)
+	}
+	return http.StatusCreated, nil, f, nil
+}
+
+func updateFlag(u *url.URL, h http.Header, l *LookupChange, c *Context) (int, http.Header, Response, error) {
+	id, complaint := lookupId(u, "Flag")
+	if complaint == "" {
+		complaint = lookupName(l, false)
+	}
+	if complaint != "" {
+		return error400(h, complaint, "bad flag change")
+	}
+	flags, err := profile.AllFlags(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: a89", err)
+	}
+	for _, f := range flags {
+		if f.Id != id {
+			continue
+		}
+		if l.Name != nil {
+			f.Name = *l.Name
+		}
+		if l.Retired != nil {
+			f.Retired = *l.Retired
+		}
+		err = f.Save(c.Ctx)
+		if err != nil {
+			return error500(h, "db failure: a103", err)
+		}
+		return http.StatusOK, nil, f, nil
+	}
+	return error404(h, "flag not found")
+}
+
+func getAllTypes(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	types, err := profile.AllTypes(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: a113", err)
+	}
+	return http.StatusOK, nil, types, nil
+}
+
+func createType(u *url.URL, h http.Header, l *LookupChange, c *Context) (int, http.Header, Response, error) {
+	if complaint := lookupName(l, true); complaint != "" {
+		return error400(h, complaint, "bad type")
+	}
+	t := profile.Utype{Name: *l.Name}
+	if l.Retired != nil {
+		t.Retired = *l.Retired
+	}
+	err := t.Create(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: a128", err)
+	}
+	return http.StatusCreated, nil, t, nil
+}
+
+func updateType(u *url.URL, h http.Header, l *LookupChange, c *Context) (int, http.Header, Response, error) {
+	id, complaint := lookupId(u, "type")
+	if complaint == "" {
+		complaint = lookupName(l, false)
+	}
+	if complaint != "" {
+		return error400(h, complaint, "bad type change")
+	}
+	types, err := profile.AllTypes(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: a142", err)
+	}
+	for _, t := range types {
+		if t.Id != id {
+			continue
+		}
+		if l.Name != nil {
+			t.Name = *l.Name
+		}
+		if l.Retired != nil {
+			t.Retired = *l.Retired
+		}
+		err = t.Save(c.Ctx)
+		if err != nil {
+			return error500(h, "db failure: a156", err)
+		}
+		return http.StatusOK, nil, t, nil
+	}
+	return error404(h, "type not found")
+}
+
+func getAllRates(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	rates, err := profile.AllRateTypes(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: a166", err)
+	}
+	return http.StatusOK, nil, rates, nil
+}
+
+func createRate(u *url.URL, h http.Header, l *LookupChange, c *Context) (int, http.Header, Response, error) {
+	if complaint := lookupName(l, true); complaint != "" {
+		return error400(h, complaint, "bad rate type")
+	}
+	r := profile.RateType{Name: *l.Name}
+	if l.Comm != nil {
+		r.Comm = *l.Comm
+	}
+	if l.Retired != nil {
+		r.Retired = *l.Retired
+	}
+	err := r.Create(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: a184", err)
+	}
+	return http.StatusCreated, nil, r, nil
+}
+
+func updateRate(u *url.URL, h http.Header, l *LookupChange, c *Context) (int, http.Header, Response, error) {
+	id, complaint := lookupId(u, "rate type")
+	if complaint == "" {
+		complaint = lookupName(l, false)
+	}
+	if complaint != "" {
+		return error400(h, complaint, "bad rate type change")
+	}
+	rates, err := profile.AllRateTypes(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: a198", err)
+	}
+	for _, r := range rates {
+		if r.Id != id {
+			continue
+		}
+		if l.Name != nil {
+			r.Name = *l.Name
+		}
+		if l.Comm != nil {
+			r.Comm = *l.Comm
+		}
+		if l.Retired != nil {
+			r.Retired = *l.Retired
+		}
+		err = r.Save(c.Ctx)
+		if err != nil {
+			return error500(h, "db failure: a215", err)
+		}
+		return http.StatusOK, nil, r, nil
+	}
+	return error404(h, "rate type not found")
+}
+
+// reorderRates takes every RateType id, in the order clients should list them.
+func reorderRates(u *url.URL, h http.Header, ids []int, c *Context) (int, http.Header, Response, error) {
+	err := profile.ReorderRateTypes(c.Ctx, ids)
+	if err != nil {
+		if errors.Is(err, profile.ErrIncompleteOrder) {
+			return error400(h, "please list every rate type id exactly once", err.Error())
+		}
+		return error500(h, "db failure: a229", err)
+	}
+	return getAllRates(u, h, nil, c)
+}
+
+// AttributeChange creates or changes an Attribute.  Only the fields present are changed,
+// except that Utype and Kind can only be set when creating.  Choices only apply to
+// choice Attributes, which must have at least one.
+type AttributeChange struct {
+	Utype   *int
+	Name    *string
+	Kind    *profile.AttributeKind
+	Choices *profile.Choices
+	Retired *bool
+}
+
+// attributeComplaint checks an AttributeChange, which must be complete if creating.
+func attributeComplaint(a *AttributeChange, creating bool) string {
+	if a == nil {
+		return "no change provided"
+	}
+	if complaint := lookupName(&LookupChange{Name: a.Name}, creating); complaint != "" {
+		return complaint
+	}
+	if !creating {
+		if a.Utype != nil || a.Kind != nil {
+			return "an attribute's type and kind can't be changed"
+		}
+	} else {
+		if a.Utype == nil {
+			return "a type is required"
+		}
+		if a.Kind == nil || !profile.AttributeKinds[*a.Kind] {
+			return "kind must be one of: text, number, choice"
+		}
+		if *a.Kind == profile.KindChoice && a.Choices == nil {
+			return "choice attributes need choices"
+		}
+	}
+	if a.Choices != nil {
+		clean := profile.Choices{}
+		for _, c := range *a.Choices {
+			if c = strings.TrimSpace(c); c != "" {
+				clean = append(clean, c)
+			}
+		}
+		if len(clean) == 0 {
+			return "choices can't be empty"
+		}
+		*a.Choices = clean
+	}
+	return ""
+}
+
+func getAllAttributes(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	attrs, err := profile.AllAttributes(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: a302", err)
+	}
+	return http.StatusOK, nil, attrs, nil
+}
+
+func createAttribute(u *url.URL, h http.Header, a *AttributeChange, c *Context) (int, http.Header, Response, error) {
+	if complaint := attributeComplaint(a, true); complaint != "" {
+		return error400(h, complaint, "bad attribute")
+	}
+	types, err := profile.AllTypes(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: a300", err)
+	}
+	found := false
+	for _, t := range types {
+		if t.Id == *a.Utype {
+			found = true
+		}
+	}
+	if !found {
+		return errorField(h, "Utype", "'"+strconv.Itoa(*a.Utype)+"' is not a valid type id", "bad attribute")
+	}
+	attr := profile.Attribute{Utype: *a.Utype, Name: *a.Name, Kind: *a.Kind, Choices: profile.Choices{}}
+	if a.Choices != nil && attr.Kind == profile.KindChoice {
+		attr.Choices = *a.Choices
+	}
+	if a.Retired != nil {
+		attr.Retired = *a.Retired
+	}
+	err = attr.Create(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: a320", err)
+	}
+	return http.StatusCreated, nil, attr, nil
+}
+
+func updateAttribute(u *url.URL, h http.Header, a *AttributeChange, c *Context) (int, http.Header, Response, error) {
+	id, complaint := lookupId(u, "attribute")
+	if complaint == "" {
+		complaint = attributeComplaint(a, false)
+	}
+	if complaint != "" {
+		return error400(h, complaint, "bad attribute change")
+	}
+	attrs, err := profile.AllAttributes(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: a335", err)
+	}
+	for _, attr := range attrs {
+		if attr.Id != id {
+			continue
+		}
+		if a.Name != nil {
+			attr.Name = *a.Name
+		}
+		if a.Choices != nil {
+			if attr.Kind != profile.KindChoice {
+				return errorField(h, "Choices", "only choice attributes have choices", "bad attribute change")
+			}
+			attr.Choices = *a.Choices
+		}
+		if a.Retired != nil {
+			attr.Retired = *a.Retired
+		}
+		err = attr.Save(c.Ctx)
+		if err != nil {
+			return error500(h, "db failure: a354", err)
+		}
+		return http.StatusOK, nil, attr, nil
+	}
+	return error404(h, "attribute not found")
+}
+
+// ExchangeChange sets how much of a Currency one profile.DefaultCurrency buys.
+type ExchangeChange struct {
+	Rate float64
+}
+
+func getExchangeRates(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	rates, err := profile.AllExchangeRates(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: a390", err)
+	}
+	return http.StatusOK, nil, rates, nil
+}
+
+func setExchangeRate(u *url.URL, h http.Header, e *ExchangeChange, c *Context) (int, http.Header, Response, error) {
+	code := param(u, "currency")
+	currency, ok := profile.GetCurrency(code)
+	if !ok {
+		return error404(h, "'"+code+"' isn't an ISO 4217 currency code")
+	}
+	if currency.Code == profile.DefaultCurrency {
+		return error400(h, profile.DefaultCurrency+" is what every rate is quoted against", "bad exchange rate")
+	}
+	if e == nil || e.Rate <= 0 {
+		return errorField(h, "Rate", "rates must be more than zero", "bad exchange rate")
+	}
+	r := profile.ExchangeRate{Currency: currency.Code, Rate: e.Rate}
+	err := r.Save(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: a411", err)
+	}
+	return http.StatusOK, nil, r, nil
+}
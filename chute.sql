@@ -18,28 +18,50 @@ create table ratetype (
  id integer primary key,
  sort integer not null unique,
  name text,
- comm text
+ comm text,
+ retired boolean not null default false
 );
 
 create table profile (
  id serial primary key,
  ratetype integer references ratetype (id) default 1,
- hourly integer,
- daily integer,
+ hourly integer not null default 0 check (hourly >= 0), -- minor units of rateunits
+ daily integer not null default 0 check (daily >= 0),
+ rateunits char(3) not null default 'USD', -- ISO 4217
  created timestamp with time zone,
  updated timestamp with time zone,
  email text,
  phone text,
  name text,
- folder text
+ folder text,
+ roles text not null default '', -- comma-separated: admin, moderator
+ suspended boolean not null default false,
+ emailvisibility varchar(40) not null default 'shared',
+ phonevisibility varchar(40) not null default 'shared',
+ deleteafter timestamp with time zone, -- purged after this, if set
+ deleted boolean not null default false,
+ currency char(3), -- ISO 4217; what to show others' rates in, if set
+ home point, -- (longitude, latitude), like free.location
+ travel integer not null default 0 check (travel >= 0) -- statute miles from home
 ); 
 
+-- how much of each currency one USD buys; maintained by admins
+create table exchange (
+ currency char(3) primary key,
+ rate double precision not null check (rate > 0),
+ updated timestamp with time zone not null
+);
+
+-- audit trail of logins, auth and profile changes, invites and photos
 create table log (
  id serial primary key,
  profile integer references profile (id),
  happened timestamp with time zone,
- event text
+ kind varchar(40) not null,
+ event text not null default '{}' -- JSON object of details
 );
+create index log_profile on log (profile, happened);
+create index log_happened on log (happened);
 
 create table auth (
  id serial primary key,
@@ -59,7 +81,12 @@ create table photo (
  profile integer not null references profile (id),
  created timestamp with time zone,
  href text not null,
- caption text
+ caption text,
+ processed boolean not null default false,
+ bytes bigint not null default 0,
+ sort integer not null default 0,
+ isprimary boolean not null default false,
+ hidden boolean not null default false
 );
 
 create table free (
@@ -75,7 +102,8 @@ create table free (
 
 create table utype (
  id serial primary key,
- name varchar(127)
+ name varchar(127),
+ retired boolean not null default false
 );
 
 create table profile_utype (
@@ -90,7 +118,8 @@ create table free_utype (
 
 create table flag (
  id serial primary key,
- name varchar(127)
+ name varchar(127),
+ retired boolean not null default false
 );
 
 create table profile_flag (
@@ -103,6 +132,24 @@ create table free_flag (
  free integer not null references free (id) on delete cascade
 );
 
+-- what profiles of each type may say about themselves; kind is text, number or choice
+create table attribute (
+ id serial primary key,
+ utype integer not null references utype (id),
+ name varchar(127) not null,
+ kind varchar(40) not null,
+ choices text not null default '[]', -- JSON list, for choice attributes
+ retired boolean not null default false,
+ unique (utype, name)
+);
+
+create table profile_attribute (
+ profile integer not null references profile (id),
+ attribute integer not null references attribute (id),
+ value text not null,
+ primary key (profile, attribute)
+);
+
 create table invite (
  id serial primary key,
  organizer integer not null references profile (id),
@@ -110,7 +157,9 @@ create table invite (
  invitestart timestamp with time zone not null,
  inviteend timestamp with time zone,
  created timestamp with time zone not null,
- place text not null
+ place text not null,
+ location point, -- (longitude, latitude) of place, if known
+ address text -- JSON object of street, city, region, postalcode, country
 );
 
 create table profile_invite (
@@ -128,6 +177,46 @@ create table message (
  photo integer null references photo (id)
 );
 
+-- complaints about a profile, photo or message, depending on kind
+create table report (
+ id serial primary key,
+ reporter integer not null references profile (id),
+ kind varchar(40) not null,
+ subject integer not null,
+ reason varchar(40) not null,
+ details text not null default '',
+ created timestamp with time zone not null,
+ status varchar(40) not null,
+ assignee integer null references profile (id),
+ resolved timestamp with time zone,
+ resolution text
+);
+
+-- every action taken by a moderator
+create table moderation (
+ id serial primary key,
+ moderator integer not null references profile (id),
+ action varchar(40) not null,
+ kind varchar(40) not null,
+ subject integer not null,
+ report integer null references report (id),
+ note text not null default '',
+ happened timestamp with time zone not null
+);
+
+-- ratings participants leave each other once an invite is over
+create table review (
+ id serial primary key,
+ invite integer not null references invite (id),
+ reviewer integer not null references profile (id),
+ reviewee integer not null references profile (id),
+ rating integer not null check (rating between 1 and 5),
+ body text not null default '',
+ created timestamp with time zone not null,
+ unique (invite, reviewer, reviewee)
+);
+create index review_reviewee on review (reviewee);
+
 insert into utype (name) values ('Model'), ('Photographer'), ('Makeup Artist');
 insert into flag (name) values ('Nude');
 
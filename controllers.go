@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"math"
+	"mime/multipart"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -18,10 +24,34 @@ import (
 type PhotoHandler struct {
 }
 
+// Photo's Href is the full size Rendition, kept for older clients; Renditions has a URL
+// for each of the sizes in profile.Renditions.  Primary marks the Profile's avatar.
 type Photo struct {
 	Id            int
 	Created       time.Time
 	Href, Caption string
+	Renditions    map[profile.Rendition]string
+	Primary       bool
+}
+
+// PhotoUpload is the response to an upload of one or more files: the Photos which
+// were created, and the reasons any files were rejected.
+type PhotoUpload struct {
+	Photos []Photo
+	Errors []PhotoUploadError
+}
+
+// PhotoUploadError identifies a rejected file by its position in the upload, since
+// Filename is whatever the client sent, and might be empty or repeated.  Status is the
+// HTTP status this file alone would have gotten: 400 for anything that isn't a usable
+// image, 413 when the file is too large or the Profile is out of room (with the Code
+// telling which), and 500 when it's our fault.  Code is as in ErrorResponse.
+type PhotoUploadError struct {
+	File     int
+	Filename string
+	Status   int
+	Code     string
+	Error    string
 }
 
 type PhotoChange struct {
@@ -29,19 +59,56 @@ type PhotoChange struct {
 	Caption string
 }
 
+// PhotoOrder lists Photo ids in the order they should be shown.  Photos not listed keep
+// their order after the listed ones.  If Primary is present, that Photo becomes the avatar.
+type PhotoOrder struct {
+	Photos  []int
+	Primary *int
+}
+
 type Profile struct {
-	Id         int
-	RateTypeId int
+	Id          int
+	RateTypeId  int
+	HourlyRate  int
+	DailyRate   int
+	RateUnits   string
+	MinorUnits  int // digits of minor units in RateUnits; rates are in minor units
+	Created     time.Time
+	Email       *string
+	Phone       *string
+	Name        *string
+	Photos      []Photo
+	Flags       []profile.Flag
+	Utypes      []profile.Utype
+	Attributes  []profile.AttributeValue
+	Roles       profile.Roles // only present for the Profile itself, or for admins
+	Rating      float64       // average of Reviews received; zero if there are none
+	Reviews     int
+	Privacy     *Privacy   // only present for the Profile itself
+	DeleteAfter *time.Time // likewise; set if the Profile has asked to be deleted
+	// the rates in the viewer's DisplayCurrency, if they have one and we can convert to it
+	Display         *Rates
+	DisplayCurrency *string // only present for the Profile itself
+	// where the Profile is based is only present for the Profile itself, but anyone can
+	// see how far it will travel.  Updates which leave either out keep what's stored, and
+	// ForgetHome drops Home.
+	Home        *profile.Location
+	TravelMiles *int
+	ForgetHome  bool `json:",omitempty"`
+}
+
+// Rates are an hourly and daily rate, in minor units of Currency.
+type Rates struct {
+	Currency   string
+	MinorUnits int
 	HourlyRate int
 	DailyRate  int
-	RateUnits  string
-	Created    time.Time
-	Email      *string
-	Phone      *string
-	Name       *string
-	Photos     []Photo
-	Flags      []profile.Flag
-	Utypes     []profile.Utype
+}
+
+// Privacy says who may see each of a Profile's contact details.
+type Privacy struct {
+	Email profile.Visibility
+	Phone profile.Visibility
 }
 
 type Auth struct {
@@ -102,6 +169,8 @@ type NewInvite struct {
 	Start     time.Time
 	End       *time.Time
 	Place     string
+	Location  *profile.Location
+	Address   *profile.Address
 	Message   *NewMessage
 }
 
@@ -113,9 +182,13 @@ type Message struct {
 	Body   string
 }
 
+// Attendee's Miles is how far they'll be from the shoot, from the Location they shared on
+// their Freetime at the Invite's Start.  Home is private, so it's missing if they didn't
+// share one, or if the Invite has no Location.
 type Attendee struct {
 	Profile
 	Status profile.Status
+	Miles  *float64
 }
 
 type Invite struct {
@@ -127,28 +200,68 @@ type Invite struct {
 	End       *time.Time
 	Created   time.Time
 	Place     string
+	Location  *profile.Location
+	Address   *profile.Address
 	Messages  []Message
+	Warnings  []string // only when creating, about Attendees who are free far from the shoot
 }
 
-func authenticate(r *http.Request) (http.Header, error) {
+func authenticate(r *http.Request) error {
 	token := r.Header.Get(ChuteToken)
 	if token == "" {
-		return nil, tigertonic.Unauthorized{errors.New("please log in")}
-	}
-	auth := new(profile.Auth)
-	auth.Token = &token
-	err := auth.Get()
-	if err != nil {
-		return nil, tigertonic.Unauthorized{errors.New("please log in")}
+		return refusal{http.StatusUnauthorized, CodeUnauthenticated, "please log in"}
 	}
 	c := tigertonic.Context(r).(*Context)
+	auth, p, err := profile.GetSession(c.Ctx, token)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return refusal{http.StatusGatewayTimeout, CodeTimeout, "that took too long; please try again"}
+	} else if errors.Is(err, context.Canceled) {
+		return refusal{http.StatusServiceUnavailable, CodeUnavailable, "request cancelled"}
+	} else if errors.Is(err, profile.ErrSuspended) {
+		return refusal{http.StatusForbidden, CodeSuspended, "this account has been suspended"}
+	} else if err != nil {
+		return refusal{http.StatusUnauthorized, CodeUnauthenticated, "please log in"}
+	}
 	c.Auth = auth
-	c.Profile = new(profile.Profile)
-	err = c.Profile.Get(auth)
+	c.Profile = p
+	return nil
+}
+
+// requireRoles returns a guard test that passes only for an authenticated Profile with
+// at least one of roles, so it must come after authenticate.
+func requireRoles(roles ...profile.Role) func(*http.Request) error {
+	return func(r *http.Request) error {
+		c := tigertonic.Context(r).(*Context)
+		if c.Profile != nil {
+			for _, role := range roles {
+				if c.Profile.Roles.Has(role) {
+					return nil
+				}
+			}
+		}
+		return refusal{http.StatusForbidden, CodeForbidden, "you don't have permission to do that"}
+	}
+}
+
+// cacheable returns the headers that let clients cache a lookup response, and whether
+// the client's copy (per If-None-Match) is already current.  The ETag is a hash of the
+// response itself, so it's the same from every server as long as the data is.
+func cacheable(h http.Header, response Response) (http.Header, bool) {
+	body, err := json.Marshal(response)
 	if err != nil {
-		return nil, tigertonic.Unauthorized{errors.New("please log in")}
+		return nil, false
 	}
-	return nil, nil
+	sum := sha1.Sum(body)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	oh := http.Header{}
+	oh.Set("ETag", etag)
+	oh.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(profile.CacheTTL.Seconds())))
+	for _, match := range strings.Split(h.Get("If-None-Match"), ",") {
+		if strings.TrimSpace(match) == etag {
+			return oh, true
+		}
+	}
+	return oh, false
 }
 
 func param(u *url.URL, param string) string {
@@ -156,7 +269,7 @@ func param(u *url.URL, param string) string {
 	return query.Get("{" + param + "}")
 }
 
-func findProfile(u *url.URL, c *Context) (*profile.Profile, func(string, ...interface{}) (int, http.Header, Response, error), error) {
+func findProfile(u *url.URL, c *Context) (*profile.Profile, func(http.Header, string, ...interface{}) (int, http.Header, Response, error), error) {
 	id := param(u, "id")
 	if id == "" {
 		return c.Profile, nil, nil
@@ -166,9 +279,9 @@ func findProfile(u *url.URL, c *Context) (*profile.Profile, func(string, ...inte
 		complaint := "'" + id + "' is not a valid Profile Id."
 		return nil, error400, errors.New(complaint)
 	}
-	ip, err := profile.GetProfile(intId)
+	ip, err := profile.GetProfile(c.Ctx, intId)
 	if err != nil {
-		if err.Error() == profile.NotFoundError {
+		if errors.Is(err, profile.ErrNotFound) {
 			return nil, error404, errors.New("profile not found")
 		}
 		return nil, error500, err
@@ -176,94 +289,275 @@ func findProfile(u *url.URL, c *Context) (*profile.Profile, func(string, ...inte
 	return ip, nil, nil
 }
 
-func (m *Message) convert(im profile.Message) error {
+func newPhoto(ph profile.Photo, folder string) Photo {
+	return Photo{ph.Id, ph.Created, ph.GetExpiringUrl(folder), ph.Caption, ph.GetExpiringUrls(folder), ph.Primary}
+}
+
+// related holds everything the Profiles and Invites in a response refer to by id, loaded
+// up front in a few queries, so that converting them doesn't have to keep running back to
+// the database for each one.
+type related struct {
+	profiles    map[int]*profile.Profile   // by Profile id
+	photos      map[int][]profile.Photo    // by Profile id
+	shared      map[int]*profile.Photo     // by Photo id, for Messages
+	reputations map[int]profile.Reputation // by Profile id
+	viewer      int                        // the Profile the response is for
+	admin       bool                       // whether viewer is an admin
+	contacts    map[int]bool               // by Profile id, those sharing an Invite with viewer
+	currency    string                     // what viewer would like to see rates in, if anything
+	exchange    profile.ExchangeRates
+	frees       map[int][]profile.Freetime // by Profile id, for Attendees of Invites with a Location
+}
+
+// loadRelated gathers what's needed to convert all of ips and iis for viewer.  The
+// Profiles we were handed (including Attendees) are used as they are; only the rest are
+// loaded.
+func loadRelated(ctx context.Context, viewer *profile.Profile, ips []profile.Profile, iis []profile.Invite) (*related, error) {
+	var err error
+	rel := &related{profiles: map[int]*profile.Profile{}, viewer: viewer.Id, admin: viewer.Roles.Has(profile.RoleAdmin)}
+	if viewer.DisplayCurrency != nil {
+		rel.currency = *viewer.DisplayCurrency
+		rel.exchange, err = profile.GetExchangeRates(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for j := range ips {
+		rel.profiles[ips[j].Id] = &ips[j]
+	}
+	var needed, photoIds, located []int
+	var earliest, latest time.Time
+	for _, ii := range iis {
+		if ii.Location != nil {
+			for _, att := range ii.Attendees {
+				located = append(located, att.Id)
+			}
+			if earliest.IsZero() || ii.Start.Before(earliest) {
+				earliest = ii.Start
+			}
+			if ii.Start.After(latest) {
+				latest = ii.Start
+			}
+		}
+		needed = append(needed, ii.Organizer)
+		for j := range ii.Attendees {
+			rel.profiles[ii.Attendees[j].Id] = &ii.Attendees[j].Profile
+		}
+		for _, im := range ii.Messages {
+			needed = append(needed, im.Sender)
+			if im.Photo != nil {
+				photoIds = append(photoIds, *im.Photo)
+			}
+		}
+	}
+
+	rel.shared, err = profile.GetPhotos(ctx, photoIds)
+	if err != nil {
+		return nil, err
+	}
+	for _, ph := range rel.shared {
+		needed = append(needed, ph.Profile)
+	}
+
+	var missing []int
+	for _, id := range needed {
+		if rel.profiles[id] == nil {
+			missing = append(missing, id)
+		}
+	}
+	loaded, err := profile.GetProfiles(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	for id, ip := range loaded {
+		rel.profiles[id] = ip
+	}
+
+	var ids []int
+	for id := range rel.profiles {
+		ids = append(ids, id)
+	}
+	rel.photos, err = profile.GetPhotosByProfile(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	rel.reputations, err = profile.GetReputations(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	rel.contacts, err = viewer.Contacts(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	rel.frees, err = profile.GetLocatedFreetimes(ctx, located, earliest, latest)
+	if err != nil {
+		return nil, err
+	}
+	return rel, nil
+}
+
+// whereabouts returns where the Profile said it will be at t, which is the Location of its
+// Freetime then, or nil.  Home is never used, since the Profile hasn't shared it.
+func (rel *related) whereabouts(ip *profile.Profile, t time.Time) *profile.Location {
+	for _, f := range rel.frees[ip.Id] {
+		if f.Covers(t) {
+			return f.Location
+		}
+	}
+	return nil
+}
+
+func (rel *related) lookup(id int) (*profile.Profile, error) {
+	ip := rel.profiles[id]
+	if ip == nil {
+		return nil, errors.New("profile " + strconv.Itoa(id) + " not loaded")
+	}
+	return ip, nil
+}
+
+func (m *Message) convert(im profile.Message, rel *related) error {
 	m.Id = im.Id
 	m.Sent = im.Sent
 	m.Body = im.Body
 
-	ip, err := profile.GetProfile(im.Sender)
+	ip, err := rel.lookup(im.Sender)
 	if err != nil {
 		return err
 	}
 	m.Sender = Profile{}
-	err = m.Sender.convert(*ip)
+	err = m.Sender.convertWith(*ip, rel)
+	if err != nil {
+		return err
+	}
 
 	if im.Photo == nil {
 		// short circuit out o' here; we're done
 		return nil
 	}
-	ph, err := profile.GetPhoto(*im.Photo)
+	ph := rel.shared[*im.Photo]
+	if ph == nil {
+		// removed since we loaded the Message; there's nothing to show
+		return nil
+	}
+	ip, err = rel.lookup(ph.Profile)
 	if err != nil {
 		return err
 	}
 
-	// dammit, we shouldn't have to keep running back to the database for this
-	ip, err = profile.GetProfile(ph.Profile)
+	photo := newPhoto(*ph, ip.Folder)
+	m.Photo = &photo
+	return nil
+}
+
+// convert is convertWith for a single Profile, when there's nothing else to load.
+func (p *Profile) convert(ctx context.Context, ip profile.Profile, viewer *profile.Profile) error {
+	rel, err := loadRelated(ctx, viewer, []profile.Profile{ip}, nil)
 	if err != nil {
 		return err
 	}
-
-	href := ph.GetExpiringUrl(ip.Folder)
-	m.Photo = &Photo{ph.Id, ph.Created, href, ph.Caption}
-	return nil
+	return p.convertWith(ip, rel)
 }
 
-func (p *Profile) convert(ip profile.Profile) error {
+func (p *Profile) convertWith(ip profile.Profile, rel *related) error {
 	p.Id = ip.Id
 	p.RateTypeId = ip.RateTypeId
 	p.DailyRate = ip.DailyRate
 	p.HourlyRate = ip.HourlyRate
 	p.RateUnits = ip.RateUnits
+	if c, ok := profile.GetCurrency(ip.RateUnits); ok {
+		p.MinorUnits = c.Minor
+		if rel.currency != "" && rel.currency != c.Code {
+			hourly, okH := rel.exchange.Convert(ip.HourlyRate, c.Code, rel.currency)
+			daily, okD := rel.exchange.Convert(ip.DailyRate, c.Code, rel.currency)
+			if okH && okD {
+				dc, _ := profile.GetCurrency(rel.currency)
+				p.Display = &Rates{dc.Code, dc.Minor, hourly, daily}
+			}
+		}
+	}
 	p.Created = ip.Created
-	p.Email = ip.Email
-	p.Phone = ip.Phone
 	p.Name = ip.Name
+	p.TravelMiles = &ip.TravelMiles
 	p.Flags = ip.Flags
 	p.Utypes = ip.Utypes
+	p.Attributes = ip.Attributes
+	p.Rating = rel.reputations[ip.Id].Rating
+	p.Reviews = rel.reputations[ip.Id].Reviews
 
-	dbPhotos, err := ip.Photos()
-	if err != nil {
-		return err
+	// contact details are only shown to those the Profile allows
+	self := ip.Id == rel.viewer
+	// who the admins and moderators are is nobody else's business
+	if self || rel.admin {
+		p.Roles = ip.Roles
+	}
+	if ip.EmailVisibility.Allows(self, rel.contacts[ip.Id]) {
+		p.Email = ip.Email
 	}
-	for _, photo := range dbPhotos {
-		href := photo.GetExpiringUrl(ip.Folder)
-		p.Photos = append(p.Photos, Photo{photo.Id, photo.Created, href, photo.Caption})
+	if ip.PhoneVisibility.Allows(self, rel.contacts[ip.Id]) {
+		p.Phone = ip.Phone
+	}
+	if self {
+		p.Privacy = &Privacy{ip.EmailVisibility, ip.PhoneVisibility}
+		p.DeleteAfter = ip.DeleteAfter
+		p.DisplayCurrency = ip.DisplayCurrency
+		p.Home = ip.Home
+	}
+
+	for _, photo := range rel.photos[ip.Id] {
+		p.Photos = append(p.Photos, newPhoto(photo, ip.Folder))
 	}
 	return nil
 }
 
-func (i *Invite) convert(ii profile.Invite) error {
+// convert is convertWith for a single Invite, when there's nothing else to load.
+func (i *Invite) convert(ctx context.Context, ii profile.Invite, viewer *profile.Profile) error {
+	rel, err := loadRelated(ctx, viewer, nil, []profile.Invite{ii})
+	if err != nil {
+		return err
+	}
+	return i.convertWith(ii, rel)
+}
+
+func (i *Invite) convertWith(ii profile.Invite, rel *related) error {
 	i.Id = ii.Id
 	i.Active = ii.Active
 	i.Start = ii.Start
 	i.End = ii.End
 	i.Created = ii.Created
 	i.Place = ii.Place
+	i.Location = ii.Location
+	i.Address = ii.Address
 
 	// Organizer and Attendees are or contain Profiles, so there's some hoops to jump through
-	ip, err := profile.GetProfile(ii.Organizer)
+	ip, err := rel.lookup(ii.Organizer)
 	if err != nil {
 		return err
 	}
 	i.Organizer = Profile{}
-	err = i.Organizer.convert(*ip)
+	err = i.Organizer.convertWith(*ip, rel)
 	if err != nil {
 		return err
 	}
 
 	for _, att := range ii.Attendees {
-		log.Println("got status", att.Status, "for attendee", att.Profile.Id)
 		p := Profile{}
-		err = p.convert(att.Profile)
+		err = p.convertWith(att.Profile, rel)
 		if err != nil {
 			return err
 		}
-		i.Attendees = append(i.Attendees, Attendee{p, att.Status})
+		a := Attendee{p, att.Status, nil}
+		if ii.Location != nil {
+			if where := rel.whereabouts(&att.Profile, ii.Start); where != nil {
+				miles := math.Round(ii.Location.MilesTo(*where)*10) / 10
+				a.Miles = &miles
+			}
+		}
+		i.Attendees = append(i.Attendees, a)
 	}
 
 	for _, im := range ii.Messages {
 		m := Message{}
-		err = m.convert(im)
+		err = m.convert(im, rel)
 		if err != nil {
 			return err
 		}
@@ -277,16 +571,19 @@ func getInvite(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.
 	id := param(u, "id")
 	intId, err := strconv.Atoi(id)
 	if err != nil {
-		return error400("'"+id+"' is not a valid Invite Id.", "Bad invite id.")
+		return error400(h, "'"+id+"' is not a valid Invite Id.", "Bad invite id.")
 	}
-	ii, err := profile.GetInvite(intId)
+	ii, err := profile.GetInvite(c.Ctx, intId)
 	if err != nil {
-		return error500("db failure: p208", err.Error())
+		if errors.Is(err, profile.ErrNotFound) {
+			return error404(h, "Invite not found.", err)
+		}
+		return error500(h, "db failure: p208", err)
 	}
 	i := Invite{}
-	err = i.convert(*ii)
+	err = i.convert(c.Ctx, *ii, c.Profile)
 	if err != nil {
-		return error500("db failure: p204", err.Error())
+		return error500(h, "db failure: p204", err)
 	}
 	return http.StatusOK, nil, i, nil
 }
@@ -295,25 +592,25 @@ func cancelInvite(u *url.URL, h http.Header, _ interface{}, c *Context) (int, ht
 	id := param(u, "id")
 	intId, err := strconv.Atoi(id)
 	if err != nil {
-		return error400("'"+id+"' is not a valid Invite Id.", "Bad invite id.")
+		return error400(h, "'"+id+"' is not a valid Invite Id.", "Bad invite id.")
 	}
-	ii, err := profile.GetInvite(intId)
+	ii, err := profile.GetInvite(c.Ctx, intId)
 	if err != nil {
-		errString := err.Error()
-		if errString == profile.NotFoundError {
-			return error404("Invite not found.", errString)
+		if errors.Is(err, profile.ErrNotFound) {
+			return error404(h, "Invite not found.", err)
 		}
-		return error500("db failure: p269", errString)
+		return error500(h, "db failure: p269", err)
 	}
-	err = ii.Cancel()
+	err = ii.Cancel(c.Ctx)
 	if err != nil {
-		return error500("db failure: p273", err.Error())
+		return error500(h, "db failure: p273", err)
 	}
+	record(h, &c.Profile.Id, profile.EventInviteCancelled, profile.Details{"invite": ii.Id})
 	ii.Active = false
 	i := Invite{}
-	err = i.convert(*ii)
+	err = i.convert(c.Ctx, *ii, c.Profile)
 	if err != nil {
-		return error500("db failure: p279", err.Error())
+		return error500(h, "db failure: p279", err)
 	}
 	return http.StatusOK, nil, i, nil
 }
@@ -322,36 +619,35 @@ func addMessage(u *url.URL, h http.Header, m *NewMessage, c *Context) (int, http
 	id := param(u, "id")
 	intId, err := strconv.Atoi(id)
 	if err != nil {
-		return error400("'"+id+"' is not a valid Invite Id.", "Bad invite id.")
+		return error400(h, "'"+id+"' is not a valid Invite Id.", "Bad invite id.")
 	}
-	ii, err := profile.GetInvite(intId)
+	ii, err := profile.GetInvite(c.Ctx, intId)
 	if err != nil {
-		errString := err.Error()
-		if errString == profile.NotFoundError {
-			return error404("Invite not found.", errString)
+		if errors.Is(err, profile.ErrNotFound) {
+			return error404(h, "Invite not found.", err)
 		}
-		return error500("db failure: p268", errString)
+		return error500(h, "db failure: p268", err)
 	}
 	// if there's a photo, check that it exists and is owned by us
 	if m.Photo != nil {
 		photoId := *m.Photo
-		_, err := c.Profile.GetPhoto(photoId)
+		_, err := c.Profile.GetPhoto(c.Ctx, photoId)
 		if err != nil {
-			return error400("'"+strconv.Itoa(photoId)+"' is not a valid Photo Id.", "Bad photo id")
+			return error400(h, "'"+strconv.Itoa(photoId)+"' is not a valid Photo Id.", "Bad photo id")
 		}
 	}
 
 	im := profile.Message{0, time.Now(), c.Profile.Id, ii.Id, m.Photo, m.Body}
-	err = im.Create()
+	err = im.Create(c.Ctx, nil)
 	if err != nil {
-		return error500("db failure: p273", err.Error())
+		return error500(h, "db failure: p273", err)
 	}
-	ii.RefreshMessages(nil)
+	ii.RefreshMessages(c.Ctx, nil)
 
 	i := Invite{}
-	err = i.convert(*ii)
+	err = i.convert(c.Ctx, *ii, c.Profile)
 	if err != nil {
-		return error500("db failure: p280", err.Error())
+		return error500(h, "db failure: p280", err)
 	}
 	return http.StatusOK, nil, i, nil
 
@@ -362,25 +658,25 @@ func changeStatus(u *url.URL, h http.Header, s *profile.Status, c *Context) (int
 	if s == nil || !profile.Statuses[status] {
 		complaint := "'" + string(status) + "' doesn't appear to be a valid status: "
 		complaint += strings.Join(profile.StatusStrings(), ", ")
-		return error400(complaint, "non-Status status update")
+		return errorField(h, "Status", complaint, "non-Status status update")
 	}
 	id := param(u, "id")
 	intId, err := strconv.Atoi(id)
 	if err != nil {
-		return error400("'"+id+"' is not a valid Invite Id.", "Bad invite id.")
+		return error400(h, "'"+id+"' is not a valid Invite Id.", "Bad invite id.")
 	}
-	ii, err := profile.GetInvite(intId)
+	ii, err := profile.GetInvite(c.Ctx, intId)
 	if err != nil {
-		errString := err.Error()
-		if errString == profile.NotFoundError {
-			return error404("Invite not found.", errString)
+		if errors.Is(err, profile.ErrNotFound) {
+			return error404(h, "Invite not found.", err)
 		}
-		return error500("db failure: p270", errString)
+		return error500(h, "db failure: p270", err)
 	}
-	err = ii.ChangeStatus(*c.Profile, status)
+	err = ii.ChangeStatus(c.Ctx, *c.Profile, status)
 	if err != nil {
-		return error500("db failure: p278", err.Error())
+		return error500(h, "db failure: p278", err)
 	}
+	record(h, &c.Profile.Id, profile.EventInviteAnswered, profile.Details{"invite": ii.Id, "status": status})
 	// let's avoid going back for another dozen db queries...
 	for i := range ii.Attendees {
 		if ii.Attendees[i].Id == c.Profile.Id {
@@ -388,9 +684,9 @@ func changeStatus(u *url.URL, h http.Header, s *profile.Status, c *Context) (int
 		}
 	}
 	i := Invite{}
-	err = i.convert(*ii)
+	err = i.convert(c.Ctx, *ii, c.Profile)
 	if err != nil {
-		return error500("db failure: p289", err.Error())
+		return error500(h, "db failure: p289", err)
 	}
 	return http.StatusOK, nil, i, nil
 }
@@ -399,65 +695,83 @@ func addAttendees(u *url.URL, h http.Header, as []int, c *Context) (int, http.He
 	id := param(u, "id")
 	intId, err := strconv.Atoi(id)
 	if err != nil {
-		return error400("'"+id+"' is not a valid Invite Id.", "Bad invite id.")
+		return error400(h, "'"+id+"' is not a valid Invite Id.", "Bad invite id.")
 	}
-	ii, err := profile.GetInvite(intId)
+	ii, err := profile.GetInvite(c.Ctx, intId)
 	if err != nil {
-		errString := err.Error()
-		if errString == profile.NotFoundError {
-			return error404("Invite not found.", errString)
+		if errors.Is(err, profile.ErrNotFound) {
+			return error404(h, "Invite not found.", err)
 		}
-		return error500("db failure: p373", errString)
+		return error500(h, "db failure: p373", err)
 	}
 	if ii.Organizer != c.Profile.Id {
-		return error403("You are not the Organizer for this Invite.", "Bad organizer!")
+		return error403(h, "You are not the Organizer for this Invite.", "Bad organizer!")
 	}
 
-	var atts []profile.Attendee
-	for _, a := range as {
-		p, err := profile.GetProfile(a)
-		if err != nil {
-			complaint := "'" + strconv.Itoa(a) + "' is not a valid Profile id."
-			return error400(complaint, "got a non-Profile Id for an attendee")
-		}
-		atts = append(atts, profile.Attendee{*p, profile.StatusPending})
+	atts, bad, err := newAttendees(c.Ctx, as)
+	if err != nil {
+		return error500(h, "db failure: p385", err)
+	} else if bad != nil {
+		complaint := "'" + strconv.Itoa(*bad) + "' is not a valid Profile id."
+		return errorField(h, "Attendees", complaint, "got a non-Profile Id for an attendee")
 	}
 
-	err = ii.AddAttendees(atts)
+	err = ii.AddAttendees(c.Ctx, atts)
 	if err != nil {
-		return error500("db failure: p392", err.Error())
+		return error500(h, "db failure: p392", err)
 	}
+	record(h, &c.Profile.Id, profile.EventAttendeesAdded, profile.Details{"invite": ii.Id, "attendees": as})
 
-	err = ii.RefreshAttendees(nil)
+	err = ii.RefreshAttendees(c.Ctx, nil)
 	if err != nil {
-		return error500("db failure: p397", err.Error())
+		return error500(h, "db failure: p397", err)
 	}
 
 	i := Invite{}
-	err = i.convert(*ii)
+	err = i.convert(c.Ctx, *ii, c.Profile)
 	if err != nil {
-		return error500("db failure: p289", err.Error())
+		return error500(h, "db failure: p289", err)
 	}
 	return http.StatusOK, nil, i, nil
 }
 
+// newAttendees loads the Profiles for a list of Attendee ids in one go, returning the
+// first id which isn't a Profile, if any.
+func newAttendees(ctx context.Context, ids []int) ([]profile.Attendee, *int, error) {
+	ips, err := profile.GetProfiles(ctx, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	var atts []profile.Attendee
+	for _, id := range ids {
+		ip := ips[id]
+		if ip == nil {
+			bad := id
+			return nil, &bad, nil
+		}
+		atts = append(atts, profile.Attendee{*ip, profile.StatusPending})
+	}
+	return atts, nil, nil
+}
+
 func invite(u *url.URL, h http.Header, i *NewInvite, c *Context) (int, http.Header, Response, error) {
 	if i.End != nil && !i.Start.Before(*i.End) {
 		complaint := i.End.String() + " is not after " + i.Start.String()
-		return error400(complaint, "got bad Invite representation")
+		return errorField(h, "End", complaint, "got bad Invite representation")
 	}
 	if len(i.Attendees) < 1 {
 		complaint := "There must be at least one attendee for an invite."
-		return error400(complaint, "got Invite without any attendees")
+		return errorField(h, "Attendees", complaint, "got Invite without any attendees")
 	}
-	var atts []profile.Attendee
-	for _, att := range i.Attendees {
-		p, err := profile.GetProfile(att)
-		if err != nil {
-			complaint := "'" + strconv.Itoa(att) + "' is not a valid Profile id."
-			return error400(complaint, "got a non-Profile Id for an attendee")
-		}
-		atts = append(atts, profile.Attendee{*p, profile.StatusPending})
+	if i.Location != nil && !i.Location.Valid() {
+		return errorField(h, "Location", "location must be a latitude and longitude", "got bad Invite location")
+	}
+	atts, bad, err := newAttendees(c.Ctx, i.Attendees)
+	if err != nil {
+		return error500(h, "db failure: p170", err)
+	} else if bad != nil {
+		complaint := "'" + strconv.Itoa(*bad) + "' is not a valid Profile id."
+		return errorField(h, "Attendees", complaint, "got a non-Profile Id for an attendee")
 	}
 	ii := profile.Invite{}
 	ii.Attendees = atts
@@ -467,53 +781,116 @@ func invite(u *url.URL, h http.Header, i *NewInvite, c *Context) (int, http.Head
 	ii.End = i.End
 	ii.Created = time.Now()
 	ii.Place = i.Place
-	err := ii.Create()
+	ii.Location = i.Location
+	ii.Address = i.Address
+	// the Invite and its first Message are saved together or not at all
+	t, err := profile.Begin(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: p171", err)
+	}
+	defer t.Rollback()
+	err = ii.Create(c.Ctx, t)
 	if err != nil {
-		return error500("db failure: p175", err.Error())
+		return error500(h, "db failure: p175", err)
 	}
 	if i.Message != nil {
 		m := profile.Message{0, time.Now(), c.Profile.Id, ii.Id, i.Message.Photo, i.Message.Body}
-		err := m.Create()
+		err := m.Create(c.Ctx, t)
 		if err != nil {
-			return error500("db failure: p245", err.Error())
+			return error500(h, "db failure: p245", err)
 		}
 	}
-	newI, err := profile.GetInvite(ii.Id)
+	err = t.Commit()
 	if err != nil {
-		return error500("db failure: p250", err.Error())
+		return error500(h, "db failure: p247", err)
+	}
+	invitesCreated.Inc()
+	record(h, &c.Profile.Id, profile.EventInviteCreated, profile.Details{"invite": ii.Id, "attendees": i.Attendees})
+	newI, err := profile.GetInvite(c.Ctx, ii.Id)
+	if err != nil {
+		return error500(h, "db failure: p250", err)
 	}
 	out := Invite{}
-	err = out.convert(*newI)
+	err = out.convert(c.Ctx, *newI, c.Profile)
+	if err != nil {
+		return error500(h, "db failure: p227", err)
+	}
+	out.Warnings, err = inviteWarnings(c.Ctx, newI)
 	if err != nil {
-		return error500("db failure: p227", err.Error())
+		return error500(h, "db failure: p233", err)
 	}
 
 	return http.StatusOK, nil, out, nil
 }
 
+// inviteWarnings lists the Attendees who said they'd be free somewhere further than
+// profile.FreetimeMiles from the shoot.  The Invite is sent anyway; this is so the
+// organizer can double check.
+func inviteWarnings(ctx context.Context, ii *profile.Invite) ([]string, error) {
+	if ii.Location == nil {
+		return nil, nil
+	}
+	var ids []int
+	for _, att := range ii.Attendees {
+		ids = append(ids, att.Id)
+	}
+	frees, err := profile.GetLocatedFreetimes(ctx, ids, ii.Start, ii.Start)
+	if err != nil {
+		return nil, err
+	}
+	var warnings []string
+	for _, att := range ii.Attendees {
+		for _, f := range frees[att.Id] {
+			if !f.Covers(ii.Start) {
+				continue
+			}
+			if miles := ii.Location.MilesTo(*f.Location); miles > profile.FreetimeMiles {
+				name := "profile " + strconv.Itoa(att.Id)
+				if att.Name != nil {
+					name = *att.Name
+				}
+				warnings = append(warnings, fmt.Sprintf("%s is free about %.0f miles from the shoot", name, miles))
+			}
+			break
+		}
+	}
+	return warnings, nil
+}
+
 // createProfile receives a hash and an optional username.
 // If there is a username, it must be unique.
-func createProfile(u *url.URL, h http.Header, r *Auth) (int, http.Header, Response, error) {
+func createProfile(u *url.URL, h http.Header, r *Auth, c *Context) (int, http.Header, Response, error) {
 	var err error
 	p := new(profile.Profile)
 	a := profile.NewAuth(r.Hash, r.Username)
 	// if Getting an Auth succeeds, there was an existing row
-	err = a.Get()
+	err = a.Get(c.Ctx)
 	if err == nil {
-		return error400("auth exists", "hash:", *r.Hash)
+		return error409(h, "auth exists")
 	}
 	a.Name = r.Name
 
-	err = p.Create()
+	// a Profile without an Auth could never be logged into, so neither is kept without the other
+	t, err := profile.Begin(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: p53", err)
+	}
+	defer t.Rollback()
+	err = p.Create(c.Ctx, t)
 	if err != nil {
-		return error500("db failure: p56", err.Error())
+		return error500(h, "db failure: p56", err)
 	}
 	a.Profile = p.Id
 
-	err = a.Create()
+	err = a.Create(c.Ctx, t)
+	if err != nil {
+		return error500(h, "db failure: p62", err)
+	}
+	err = t.Commit()
 	if err != nil {
-		return error500("db failure: p62", err.Error())
+		return error500(h, "db failure: p66", err)
 	}
+	record(h, &p.Id, profile.EventProfileCreated, profile.Details{"auth": a.Id})
 
 	// if all is well...
 	oh := http.Header{}
@@ -524,19 +901,21 @@ func createProfile(u *url.URL, h http.Header, r *Auth) (int, http.Header, Respon
 
 func connectAuth(u *url.URL, h http.Header, r *AuthConnect, c *Context) (int, http.Header, Response, error) {
 	a := profile.NewAuth(&r.Hash, nil)
-	err := a.Get()
+	err := a.Get(c.Ctx)
 	if err != nil {
-		return error400("couldn't find that auth", err.Error())
+		return error400(h, "couldn't find that auth", err.Error())
 	}
 	if a.Username != nil {
-		return error400("can't connect a username and password to another account")
+		return error400(h, "can't connect a username and password to another account")
 	}
 	// this is the only change we make at this endpoint
+	from := a.Profile
 	a.Profile = c.Profile.Id
-	err = a.Save()
+	err = a.Save(c.Ctx)
 	if err != nil {
-		return error500("db failure: p520", err.Error())
+		return error500(h, "db failure: p520", err)
 	}
+	record(h, &c.Profile.Id, profile.EventAuthConnected, profile.Details{"auth": a.Id, "from": from})
 	return getAuths(u, h, nil, c)
 }
 
@@ -548,29 +927,37 @@ func updateAuth(u *url.URL, h http.Header, r *AuthChange, c *Context) (int, http
 		a.Hash = []byte(*r.Hash)
 		a.Username = r.Username
 	}
-	err := a.Get()
+	err := a.Get(c.Ctx)
 	if err != nil {
-		return error400("couldn't find that auth", err.Error())
+		return error400(h, "couldn't find that auth", err.Error())
 	}
 	if a.Profile != c.Profile.Id {
-		return error400("unauthorized access")
+		return error400(h, "unauthorized access")
 	}
 	if r.Hash != nil {
 		a.InHash = []byte(*r.Hash)
 	}
+	details := profile.Details{"auth": a.Id, "hash": r.Hash != nil}
+	if !reflect.DeepEqual(a.Username, r.Username) {
+		details["username"] = true
+	}
+	if a.Authorized != r.Authorized {
+		details["authorized"] = r.Authorized
+	}
 	a.Username = r.Username
 	a.Name = r.Name
 	a.Authorized = r.Authorized
-	err = a.Save()
+	err = a.Save(c.Ctx)
 	if err != nil {
-		return error500("db failure: p544", err.Error())
+		return error500(h, "db failure: p544", err)
 	}
+	record(h, &c.Profile.Id, profile.EventAuthChanged, details)
 	return getAuths(u, h, nil, c)
 }
 
 func createAuth(u *url.URL, h http.Header, r *AuthCreate, c *Context) (int, http.Header, Response, error) {
 	a := profile.NewAuth(&r.Hash, r.Username)
-	err := a.Get()
+	err := a.Get(c.Ctx)
 	if err != nil {
 		// this auth doesn't already exist
 		a.Name = r.Name
@@ -578,31 +965,75 @@ func createAuth(u *url.URL, h http.Header, r *AuthCreate, c *Context) (int, http
 		a.Profile = c.Profile.Id
 		a.InHash = []byte(r.Hash)
 		a.Username = r.Username
-		err = a.Create()
+		err = a.Create(c.Ctx, nil)
 		if err != nil {
-			return error500("db failure: p560", err.Error())
+			return error500(h, "db failure: p560", err)
 		}
+		record(h, &c.Profile.Id, profile.EventAuthCreated, profile.Details{"auth": a.Id, "username": a.Username != nil})
 		return getAuths(u, h, nil, c)
 	}
-	return error400("unauthorized access")
+	return error400(h, "unauthorized access")
 }
 
-func login(u *url.URL, h http.Header, r *Auth) (int, http.Header, Response, error) {
+func login(u *url.URL, h http.Header, r *Auth, c *Context) (int, http.Header, Response, error) {
 	if r == nil {
-		return error400("no authorization provided")
-	}
+		return error400(h, "no authorization provided")
+	}
+	// throttled and failed logins get the same response whether or not the username
+	// exists, so that they can't be used to find out
+	// logins are throttled by the address the connection came from, or the one in
+	// X-Forwarded-For only when the request came through a trusted proxy
+	keys := []profile.ThrottleKey{}
+	if ip := clientAddress(h); ip != "" {
+		keys = append(keys, profile.AddressKey(ip))
+	}
+	if r.Username != nil {
+		keys = append(keys, profile.UsernameKey(*r.Username))
+	}
+	// the attempt holds its place from here, so guesses sent at once are throttled too
+	wait, attempt := profile.AttemptLogin(keys...)
+	if wait > 0 {
+		logins.Inc("throttled")
+		return error429(h, wait, "too many failed logins; please wait and try again", "throttled")
+	}
+	defer attempt.Release()
 	auth := profile.NewAuth(r.Hash, r.Username)
-	err := auth.Get()
-	log.Println("got auth:", auth)
+	err := auth.Authenticate(c.Ctx)
+	if errors.Is(err, profile.ErrBadLogin) {
+		var id *int
+		details := profile.Details{"reason": "no such auth"}
+		if auth.Id != 0 {
+			id = &auth.Profile
+			details = profile.Details{"auth": auth.Id, "reason": "not authenticated"}
+		} else if r.Username != nil {
+			details["username"] = *r.Username
+		}
+		logins.Inc("failed")
+		record(h, id, profile.EventLoginFailed, details)
+		if attempt.Failed() {
+			details["lockout"] = profile.LoginLockout.String()
+			record(h, id, profile.EventLockedOut, details)
+		}
+		return error401(h, "login failure", details["reason"])
+	} else if err != nil {
+		return error500(h, "db failure: p131", err)
+	}
+	attempt.Succeeded()
+	p := new(profile.Profile)
+	err = p.Get(c.Ctx, &auth)
 	if err != nil {
-		return error401("login failure", "no such auth!")
-	} else if !auth.Authenticated() {
-		return error401("login failure", "hash:", *r.Hash)
+		return error500(h, "db failure: p133", err)
+	} else if p.Suspended {
+		logins.Inc("suspended")
+		record(h, &p.Id, profile.EventLoginFailed, profile.Details{"auth": auth.Id, "reason": "suspended"})
+		return abort(h, http.StatusForbidden, CodeSuspended, "this account has been suspended", nil, []interface{}{"suspended profile", p.Id})
 	}
-	token, err := auth.Login()
+	token, err := auth.Login(c.Ctx)
 	if err != nil {
-		return error500("db failure: p137", err.Error())
+		return error500(h, "db failure: p137", err)
 	}
+	logins.Inc("succeeded")
+	record(h, &p.Id, profile.EventLogin, profile.Details{"auth": auth.Id})
 
 	oh := http.Header{}
 	oh.Add(ChuteToken, token)
@@ -611,19 +1042,20 @@ func login(u *url.URL, h http.Header, r *Auth) (int, http.Header, Response, erro
 }
 
 func logout(u *url.URL, h http.Header, r *Auth, c *Context) (int, http.Header, Response, error) {
-	err := c.Auth.Logout()
+	err := c.Auth.Logout(c.Ctx)
 	if err != nil {
-		return error500("db failure: p110", err.Error())
+		return error500(h, "db failure: p110", err)
 	}
+	record(h, &c.Profile.Id, profile.EventLogout, profile.Details{"auth": c.Auth.Id})
 	return http.StatusOK, nil, struct{}{}, nil
 
 }
 
 func getAuths(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
 	var out []Auth
-	auths, err := c.Profile.GetAuths()
+	auths, err := c.Profile.GetAuths(c.Ctx)
 	if err != nil {
-		return error500("db failure: p102", err.Error())
+		return error500(h, "db failure: p102", err)
 	}
 	for _, auth := range auths {
 		out = append(out, Auth{auth.Id, auth.Profile, nil, auth.Username, auth.Name, auth.Token, auth.Created, auth.Updated, auth.LastAuth, auth.Authorized})
@@ -655,7 +1087,7 @@ func getMyInvitesBySearch(u *url.URL, h http.Header, _ interface{}, c *Context)
 		} else if a == "true" {
 			active = &tmpTrue
 		} else {
-			return error400("didn't understand '"+a+"' as a value for 'active'", a)
+			return error400(h, "didn't understand '"+a+"' as a value for 'active'", a)
 		}
 	}
 	s := query["status"]
@@ -665,7 +1097,7 @@ func getMyInvitesBySearch(u *url.URL, h http.Header, _ interface{}, c *Context)
 	if t := query.Get("from"); len(t) > 0 {
 		from, err = time.Parse(time.RFC3339Nano, t)
 		if err != nil {
-			return error400("didn't understand '"+t+"' as a search time", err.Error())
+			return error400(h, "didn't understand '"+t+"' as a search time", err.Error())
 		}
 	} else {
 		from = time.Now()
@@ -673,20 +1105,24 @@ func getMyInvitesBySearch(u *url.URL, h http.Header, _ interface{}, c *Context)
 	if t := query.Get("to"); len(t) > 0 {
 		to, err = time.Parse(time.RFC3339Nano, t)
 		if err != nil {
-			return error400("didn't understand '"+t+"' as a search time", err.Error())
+			return error400(h, "didn't understand '"+t+"' as a search time", err.Error())
 		}
 	} else {
 		to = time.Now().AddDate(0, 0, 90) // 90 days from now is the default
 	}
-	iis, err := c.Profile.GetInvites(statuses, from, to, active)
+	iis, err := c.Profile.GetInvites(c.Ctx, statuses, from, to, active)
+	if err != nil {
+		return error500(h, "db failure: p409", err)
+	}
+	rel, err := loadRelated(c.Ctx, c.Profile, nil, iis)
 	if err != nil {
-		return error500("db failure: p409", err.Error())
+		return error500(h, "db failure: p414", err)
 	}
 	for _, ii := range iis {
 		i = Invite{}
-		err = i.convert(ii)
+		err = i.convertWith(ii, rel)
 		if err != nil {
-			return error500("db failure: p418", err.Error())
+			return error500(h, "db failure: p418", err)
 		}
 		is = append(is, i)
 	}
@@ -698,6 +1134,12 @@ getProfilesBySearch pulls from the URL
 'from': ISO-8601 timestamp to find profiles with free time surrounding.
 'type': the Profile type to search for (multiple specifications are ORed together)
 'flag': the flags to search for (multiple specifications are ANDed together)
+'attr': an attribute value to search for, as "{attribute id}:{value}"
+'attrmin', 'attrmax': bounds on a number attribute, as "{attribute id}:{number}"
+(attribute specifications of all three kinds are ANDed together)
+'sort': "reputation" for the best reviewed first.
+'mode': "travel" to find profiles based close enough to travel to 'lat' and 'lon' (both
+required), ignoring 'from' and free times; "free" (the default) otherwise.
 */
 func getProfilesBySearch(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
 	var (
@@ -712,19 +1154,19 @@ func getProfilesBySearch(u *url.URL, h http.Header, _ interface{}, c *Context) (
 	if la := query.Get("lat"); len(la) > 0 {
 		lat, err = strconv.ParseFloat(la, 32)
 		if err != nil {
-			return error400("didn't understand '"+la+"' as a latitude", err.Error())
+			return error400(h, "didn't understand '"+la+"' as a latitude", err.Error())
 		}
 	}
 	if lo := query.Get("lon"); len(lo) > 0 {
 		lon, err = strconv.ParseFloat(lo, 32)
 		if err != nil {
-			return error400("didn't understand '"+lo+"' as a longitude", err.Error())
+			return error400(h, "didn't understand '"+lo+"' as a longitude", err.Error())
 		}
 	}
 	if f := query.Get("from"); len(f) > 0 {
 		from, err = time.Parse(time.RFC3339Nano, f)
 		if err != nil {
-			return error400("didn't understand '"+f+"' as a search time", err.Error())
+			return error400(h, "didn't understand '"+f+"' as a search time", err.Error())
 		}
 	} else {
 		from = time.Now()
@@ -732,27 +1174,89 @@ func getProfilesBySearch(u *url.URL, h http.Header, _ interface{}, c *Context) (
 	flags := query["flag"]
 	for _, flag := range flags {
 		if _, err := strconv.ParseInt(flag, 10, 0); err != nil {
-			return error400("didn't understand '"+flag+"' as a flag", err.Error())
+			return error400(h, "didn't understand '"+flag+"' as a flag", err.Error())
 		}
 	}
 	utypes := query["type"]
 	for _, t := range utypes {
 		if _, err := strconv.ParseInt(t, 10, 0); err != nil {
-			return error400("didn't understand '"+t+"' as a profile type", err.Error())
+			return error400(h, "didn't understand '"+t+"' as a profile type", err.Error())
+		}
+	}
+	var attrs []profile.AttributeFilter
+	all, err := profile.AllAttributes(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: p1181", err)
+	}
+	kinds := map[int]profile.AttributeKind{}
+	for _, a := range all {
+		kinds[a.Id] = a.Kind
+	}
+	for _, name := range []string{"attr", "attrmin", "attrmax"} {
+		for _, a := range query[name] {
+			parts := strings.SplitN(a, ":", 2)
+			id, err := strconv.Atoi(parts[0])
+			if err != nil || len(parts) != 2 {
+				return error400(h, "didn't understand '"+a+"' as an attribute; please send {id}:{value}", name)
+			}
+			kind, ok := kinds[id]
+			if !ok {
+				return error400(h, "'"+parts[0]+"' is not a valid attribute id", name)
+			}
+			f := profile.AttributeFilter{Attribute: id}
+			if name == "attr" {
+				f.Value = &parts[1]
+			} else {
+				// only number attributes can be compared, since the rest needn't be numbers
+				if kind != profile.KindNumber {
+					return error400(h, "'"+parts[0]+"' is not a number attribute, so can't be searched by "+name, name)
+				}
+				n, err := strconv.ParseFloat(parts[1], 64)
+				if err != nil {
+					return error400(h, "didn't understand '"+parts[1]+"' as a number", err.Error())
+				}
+				if name == "attrmin" {
+					f.Min = &n
+				} else {
+					f.Max = &n
+				}
+			}
+			attrs = append(attrs, f)
+		}
+	}
+	order := profile.SearchOrder(query.Get("sort"))
+	if order != profile.SortAny && order != profile.SortReputation {
+		return error400(h, "didn't understand '"+string(order)+"' as a sort", "bad search sort")
+	}
+	var ips []profile.Profile
+	switch mode := query.Get("mode"); mode {
+	case "travel":
+		if query.Get("lat") == "" || query.Get("lon") == "" {
+			return error400(h, "please say where the shoot is with 'lat' and 'lon'", "travel search without location")
 		}
+		searches.Inc("travel")
+		ips, err = c.Profile.SearchTravelling(c.Ctx, utypes, flags, attrs, float32(lat), float32(lon), order)
+	case "", "free":
+		searches.Inc("free")
+		// get all profiles with freetimes surrounding this 'from'
+		// we start with the autenticated profile to get the lat and long without having to pass it
+		ips, err = c.Profile.Search(c.Ctx, from, utypes, flags, attrs, float32(lat), float32(lon), order)
+	default:
+		return error400(h, "didn't understand '"+mode+"' as a search mode", "bad search mode")
 	}
-	// get all profiles with freetimes surrounding this 'from'
-	// we start with the autenticated profile to get the lat and long without having to pass it
-	ips, err := c.Profile.Search(from, utypes, flags, float32(lat), float32(lon))
 	if err != nil {
-		return error500("db failure: p205", err.Error())
+		return error500(h, "db failure: p205", err)
 	}
 
+	rel, err := loadRelated(c.Ctx, c.Profile, ips, nil)
+	if err != nil {
+		return error500(h, "db failure: p243", err)
+	}
 	for _, ip := range ips {
 		p = Profile{}
-		err = p.convert(ip)
+		err = p.convertWith(ip, rel)
 		if err != nil {
-			return error500("db failure: p247", err.Error())
+			return error500(h, "db failure: p247", err)
 		}
 		ps = append(ps, p)
 	}
@@ -765,50 +1269,83 @@ func getProfile(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http
 	var ip *profile.Profile
 	ip, errType, err := findProfile(u, c)
 	if err != nil {
-		return errType("profile not found", err.Error())
+		return errType(h, "profile not found", err.Error())
 	}
 	p = Profile{}
-	err = p.convert(*ip)
+	err = p.convert(c.Ctx, *ip, c.Profile)
 	if err != nil {
-		return error500("db failure: p188", err.Error())
+		return error500(h, "db failure: p188", err)
 	}
 	return http.StatusOK, nil, p, nil
 }
 
-func getFlags(u *url.URL, h http.Header, _ interface{}) (int, http.Header, Response, error) {
-	flags, err := profile.GetFlags()
+func getFlags(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	flags, err := profile.GetFlags(c.Ctx)
 	if err != nil {
-		return error500("db failure: p220", err.Error())
+		return error500(h, "db failure: p220", err)
+	}
+	oh, current := cacheable(h, flags)
+	if current {
+		return http.StatusNotModified, oh, nil, nil
 	}
-	return http.StatusOK, nil, flags, nil
+	return http.StatusOK, oh, flags, nil
 }
 
-func getRates(u *url.URL, h http.Header, _ interface{}) (int, http.Header, Response, error) {
-	rates, err := profile.GetRateTypes()
+func getAttributes(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	attrs, err := profile.GetAttributes(c.Ctx)
 	if err != nil {
-		return error500("db failure: p762", err.Error())
+		return error500(h, "db failure: p1052", err)
+	}
+	oh, current := cacheable(h, attrs)
+	if current {
+		return http.StatusNotModified, oh, nil, nil
+	}
+	return http.StatusOK, oh, attrs, nil
+}
+
+func getCurrencies(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	currencies := profile.GetCurrencies()
+	oh, current := cacheable(h, currencies)
+	if current {
+		return http.StatusNotModified, oh, nil, nil
 	}
-	return http.StatusOK, nil, rates, nil
+	return http.StatusOK, oh, currencies, nil
 }
 
-func getTypes(u *url.URL, h http.Header, _ interface{}) (int, http.Header, Response, error) {
-	types, err := profile.GetTypes()
+func getRates(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	rates, err := profile.GetRateTypes(c.Ctx)
 	if err != nil {
-		return error500("db failure: p228", err.Error())
+		return error500(h, "db failure: p762", err)
 	}
-	return http.StatusOK, nil, types, nil
+	oh, current := cacheable(h, rates)
+	if current {
+		return http.StatusNotModified, oh, nil, nil
+	}
+	return http.StatusOK, oh, rates, nil
+}
+
+func getTypes(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	types, err := profile.GetTypes(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: p228", err)
+	}
+	oh, current := cacheable(h, types)
+	if current {
+		return http.StatusNotModified, oh, nil, nil
+	}
+	return http.StatusOK, oh, types, nil
 }
 
 func getFreetime(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
 	var fs []Freetime
 	p, errType, err := findProfile(u, c)
 	if err != nil {
-		return errType("profile not found", err.Error())
+		return errType(h, "profile not found", err.Error())
 	}
 
-	profileFs, err := p.GetFreetimes()
+	profileFs, err := p.GetFreetimes(c.Ctx)
 	if err != nil {
-		return error500("db failure: p212", err.Error())
+		return error500(h, "db failure: p212", err)
 	}
 	for _, f := range profileFs {
 		fs = append(fs, Freetime{f.Start, f.End, f.Location, f.Utypes, f.Flags})
@@ -817,9 +1354,9 @@ func getFreetime(u *url.URL, h http.Header, _ interface{}, c *Context) (int, htt
 }
 
 func removeAllFreetime(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
-	err := c.Profile.RemoveAllFreetime()
+	err := c.Profile.RemoveAllFreetime(c.Ctx)
 	if err != nil {
-		return error500("db failure: p238", err.Error())
+		return error500(h, "db failure: p238", err)
 	}
 	return http.StatusNoContent, nil, nil, nil
 }
@@ -829,11 +1366,11 @@ func removeFreetime(u *url.URL, h http.Header, _ interface{}, c *Context) (int,
 	s := param(u, "start")
 	start, err := time.Parse(time.RFC3339Nano, s)
 	if err != nil {
-		return error500("didn't understand '"+s+"' as a start time", err.Error())
+		return error500(h, "didn't understand '"+s+"' as a start time", err)
 	}
-	err = c.Profile.RemoveFreetime(start)
+	err = c.Profile.RemoveFreetime(c.Ctx, start)
 	if err != nil {
-		return error500("db failure: p253", err.Error())
+		return error500(h, "db failure: p253", err)
 	}
 	return getFreetime(u, h, nil, c)
 }
@@ -843,130 +1380,288 @@ func createFreetime(u *url.URL, h http.Header, fs []Freetime, c *Context) (int,
 	for _, f := range fs {
 		if !f.Start.Before(f.End) {
 			complaint := f.End.String() + " is not after " + f.Start.String()
-			return error400(complaint, "got bad Freetime representation")
+			return errorField(h, "End", complaint, "got bad Freetime representation")
 		}
 		// I'm not doing the create/insert here because I don't want to insert a random number
 		// of these before having an error.   So we have to loop over range fs twice, which is
 		// not very nice, but not sure how else to handle it.
 	}
-	var err error
+	t, err := profile.Begin(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: p219", err)
+	}
+	defer t.Rollback()
 	for _, f := range fs {
-		err = c.Profile.NewFreetime(f.Start, f.End, f.Location, f.Utypes, f.Flags)
+		// a Freetime with the same Start is replaced
+		err = c.Profile.NewFreetime(c.Ctx, t, f.Start, f.End, f.Location, f.Utypes, f.Flags)
 		if err != nil {
-			if err.Error() == profile.DuplicateFreetimeError {
-				err = c.Profile.UpdateFreetime(f.Start, f.End, f.Location, f.Utypes, f.Flags)
-				if err != nil {
-					return error500("db failure: p261", err.Error())
-				}
-				continue
-			}
-			return error500("db failure: p223", err.Error())
+			return error500(h, "db failure: p223", err)
 		}
 	}
+	err = t.Commit()
+	if err != nil {
+		return error500(h, "db failure: p227", err)
+	}
 	return getFreetime(u, h, nil, c)
 }
 
 func updateProfile(u *url.URL, h http.Header, p *Profile, c *Context) (int, http.Header, Response, error) {
+	before := *c.Profile
+	if p.Privacy != nil {
+		for _, v := range []profile.Visibility{p.Privacy.Email, p.Privacy.Phone} {
+			if !profile.Visibilities[v] {
+				complaint := "'" + string(v) + "' doesn't appear to be a valid visibility: "
+				complaint += strings.Join(profile.VisibilityStrings(), ", ")
+				return errorField(h, "Privacy", complaint, "bad privacy setting")
+			}
+		}
+		c.Profile.EmailVisibility = p.Privacy.Email
+		c.Profile.PhoneVisibility = p.Privacy.Phone
+	}
+	// rates are stored as 32-bit integers
+	if p.HourlyRate < 0 || p.HourlyRate > math.MaxInt32 {
+		return errorField(h, "HourlyRate", fmt.Sprintf("rates must be between 0 and %d", math.MaxInt32), "bad rate")
+	} else if p.DailyRate < 0 || p.DailyRate > math.MaxInt32 {
+		return errorField(h, "DailyRate", fmt.Sprintf("rates must be between 0 and %d", math.MaxInt32), "bad rate")
+	}
+	units := p.RateUnits
+	if units == "" {
+		units = c.Profile.RateUnits
+	}
+	currency, ok := profile.GetCurrency(units)
+	if !ok {
+		return errorField(h, "RateUnits", "'"+units+"' isn't an ISO 4217 currency code", "bad rate units")
+	}
+	if p.DisplayCurrency != nil {
+		if *p.DisplayCurrency == "" {
+			c.Profile.DisplayCurrency = nil
+		} else if dc, ok := profile.GetCurrency(*p.DisplayCurrency); ok {
+			c.Profile.DisplayCurrency = &dc.Code
+		} else {
+			return errorField(h, "DisplayCurrency", "'"+*p.DisplayCurrency+"' isn't an ISO 4217 currency code", "bad display currency")
+		}
+	}
+	if p.Home != nil && !p.Home.Valid() {
+		return errorField(h, "Home", "home must be a latitude and longitude", "bad home location")
+	}
+	if p.TravelMiles != nil && (*p.TravelMiles < 0 || *p.TravelMiles > maxTravelMiles) {
+		return errorField(h, "TravelMiles", fmt.Sprintf("travel distance must be between 0 and %d miles", maxTravelMiles), "bad travel distance")
+	}
+	if p.ForgetHome {
+		c.Profile.Home = nil
+	} else if p.Home != nil {
+		c.Profile.Home = p.Home
+	}
+	if p.TravelMiles != nil {
+		c.Profile.TravelMiles = *p.TravelMiles
+	}
 	// we're already authed, so we just have to update and save, right?
 	c.Profile.RateTypeId = p.RateTypeId
 	c.Profile.HourlyRate = p.HourlyRate
 	c.Profile.DailyRate = p.DailyRate
-	c.Profile.RateUnits = p.RateUnits
+	c.Profile.RateUnits = currency.Code
 	c.Profile.Email = p.Email
 	c.Profile.Phone = p.Phone
 	c.Profile.Name = p.Name
 	c.Profile.Flags = p.Flags
 	c.Profile.Utypes = p.Utypes
-	err := c.Profile.Save()
+	// Attributes are only replaced if sent, but either way must suit the Utypes
+	if p.Attributes != nil {
+		complaint, err := c.Profile.CheckAttributes(c.Ctx, p.Attributes)
+		if err != nil {
+			return error500(h, "db failure: p1131", err)
+		}
+		if complaint != "" {
+			return errorField(h, "Attributes", complaint, "bad profile attributes")
+		}
+		c.Profile.Attributes = p.Attributes
+	} else {
+		err := c.Profile.PruneAttributes(c.Ctx)
+		if err != nil {
+			return error500(h, "db failure: p1140", err)
+		}
+	}
+	err := c.Profile.Save(c.Ctx)
 	if err != nil {
-		return error500("db failure: p308", err.Error())
+		return error500(h, "db failure: p308", err)
+	}
+	if changed := changedFields(before, *c.Profile); len(changed) > 0 {
+		record(h, &c.Profile.Id, profile.EventProfileChanged, profile.Details{"fields": changed})
 	}
 	out := Profile{}
-	err = out.convert(*c.Profile)
+	err = out.convert(c.Ctx, *c.Profile, c.Profile)
 	if err != nil {
-		return error500("db failure: p313", err.Error())
+		return error500(h, "db failure: p313", err)
 	}
 	return http.StatusOK, nil, out, nil
 }
 
 func updatePhoto(u *url.URL, h http.Header, p *PhotoChange, c *Context) (int, http.Header, Response, error) {
-	photo, err := c.Profile.GetPhoto(p.Id)
+	photo, err := c.Profile.GetPhoto(c.Ctx, p.Id)
 	if err != nil {
-		return error400("'"+string(p.Id)+"' is not a valid Photo id.", "Bad photo id.")
+		return error400(h, "'"+strconv.Itoa(p.Id)+"' is not a valid Photo id.", "Bad photo id.")
 	}
 	photo.Caption = p.Caption
-	err = photo.Save()
+	err = photo.Save(c.Ctx)
 	if err != nil {
-		return error500("db failure: p837", err.Error())
+		return error500(h, "db failure: p837", err)
 	}
-	href := photo.GetExpiringUrl(c.Profile.Folder)
-	out := Photo{photo.Id, photo.Created, href, photo.Caption}
+	out := newPhoto(photo, c.Profile.Folder)
 	return http.StatusOK, nil, out, nil
 
 }
 
+func reorderPhotos(u *url.URL, h http.Header, o *PhotoOrder, c *Context) (int, http.Header, Response, error) {
+	if o == nil {
+		return error400(h, "no photo order provided")
+	}
+	err := c.Profile.ReorderPhotos(c.Ctx, o.Photos, o.Primary)
+	if err != nil {
+		if errors.Is(err, profile.ErrNotFound) {
+			return error400(h, "all photos must be your own", "bad photo id in reorder")
+		}
+		return error500(h, "db failure: p931", err)
+	}
+	photos, err := c.Profile.Photos(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: p936", err)
+	}
+	out := []Photo{}
+	for _, photo := range photos {
+		out = append(out, newPhoto(photo, c.Profile.Folder))
+	}
+	return http.StatusOK, nil, out, nil
+}
+
 func removePhoto(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
 	id := u.Query().Get("{id}")
 	intId, err := strconv.Atoi(id)
 	if err != nil {
-		return error400("'"+id+"' is not a valid Photo id.", "Bad photo id.")
+		return error400(h, "'"+id+"' is not a valid Photo id.", "Bad photo id.")
 	}
-	photo, err := c.Profile.GetPhoto(intId)
+	photo, err := c.Profile.GetPhoto(c.Ctx, intId)
 	if err != nil {
-		return error404("photo not found", err.Error())
+		return error404(h, "photo not found", err.Error())
 	}
-	err = photo.Remove()
+	err = photo.Remove(c.Ctx, c.Profile.Folder)
 	if err != nil {
-		return error500("photo removal error: p220", err.Error())
+		return error500(h, "photo removal error: p220", err)
 	}
+	record(h, &c.Profile.Id, profile.EventPhotoRemoved, profile.Details{"photo": photo.Id})
 	return http.StatusNoContent, nil, nil, nil
 }
 
-// PhotoHandler.ServeHTTP currently handles only the first file uploaded.
+// PhotoHandler.ServeHTTP handles every "photo" part uploaded, each paired with the
+// "caption" part in the same position, if there is one.  Each file stands or falls on
+// its own: the response lists the Photos created and an error for each file that wasn't.
+// Only if no file at all could be saved is the response an error status.
 func (ph PhotoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var complaint string
-	file, meta, err := r.FormFile("photo")
-	if err != nil {
-		complaint = `{"error": "file upload issue: p200"}`
-		log.Println(complaint, err.Error())
-		w.WriteHeader(500)
-		w.Write([]byte(complaint + "\n"))
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	err := r.ParseMultipartForm(maxPhotoMemory)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		complaint := fmt.Sprintf("uploads are limited to %d bytes in total", maxUploadBytes)
+		writeComplaint(w, r, 413, complaint, err)
+		return
+	} else if err != nil {
+		writeComplaint(w, r, 400, "couldn't understand that upload; please send multipart/form-data", err)
 		return
 	}
-	typeArray := meta.Header["Content-Type"]
-	if len(typeArray) < 1 || !allowedPhotoTypes[typeArray[0]] {
-		complaint = `{"error": "please upload only an image file in jpg, gif, or png"}`
-		log.Println(complaint)
-		w.WriteHeader(400)
-		w.Write([]byte(complaint + "\n"))
+	files := r.MultipartForm.File["photo"]
+	if len(files) < 1 {
+		writeComplaint(w, r, 400, "please upload at least one photo", nil)
 		return
 	}
-	ctype := typeArray[0]
+	captions := r.MultipartForm.Value["caption"]
 
-	fmt.Println(r.FormValue("caption"))
 	c := tigertonic.Context(r).(*Context)
-	photo := c.Profile.NewPhoto(r.FormValue("caption"))
-	_, err = photo.Create(c.Profile.Folder, ctype, file)
-	if err != nil {
-		complaint = `{"error": "file upload issue: p244"}`
-		log.Println(complaint, err.Error())
-		w.WriteHeader(500)
-		w.Write([]byte(complaint + "\n"))
-		return
+	out := PhotoUpload{Photos: []Photo{}, Errors: []PhotoUploadError{}}
+	status := 400
+	for i, meta := range files {
+		caption := ""
+		if i < len(captions) {
+			caption = captions[i]
+		}
+		photo, failure, err := uploadPhoto(c.Ctx, c.Profile, meta, caption)
+		if err != nil {
+			logger(r.Header).Info(failure.Error, "file", i, "filename", meta.Filename, "error", err)
+			failure.File = i
+			failure.Filename = meta.Filename
+			out.Errors = append(out.Errors, failure)
+			if failure.Status > status {
+				status = failure.Status
+			}
+			continue
+		}
+		record(r.Header, &c.Profile.Id, profile.EventPhotoAdded, profile.Details{"photo": photo.Id})
+		out.Photos = append(out.Photos, newPhoto(photo, c.Profile.Folder))
+	}
+	if len(out.Photos) > 0 {
+		status = 200
 	}
-	href := photo.GetExpiringUrl(c.Profile.Folder)
-	output, err := json.Marshal(Photo{photo.Id, photo.Created, href, photo.Caption})
+
+	output, err := json.Marshal(out)
 	if err != nil {
-		complaint = `{"error": "file upload issue: p874"}`
-		log.Println(complaint, err.Error())
-		w.WriteHeader(500)
-		w.Write([]byte(complaint + "\n"))
+		writeComplaint(w, r, 500, "file upload issue: p874", err)
 		return
 	}
+	w.WriteHeader(status)
 	_, err = w.Write([]byte(output))
 	if err != nil {
-		log.Println("WTF? p226", err.Error())
+		logger(r.Header).Warn("couldn't send upload response: p226", "error", err)
+	}
+}
+
+// uploadPhoto validates and saves a single uploaded file for PhotoHandler.  On failure,
+// it returns the status, code and complaint the client should see along with the error.
+//
+// The client's Content-Type for the part is ignored; we look at the bytes instead.
+func uploadPhoto(ctx context.Context, p *profile.Profile, meta *multipart.FileHeader, caption string) (profile.Photo, PhotoUploadError, error) {
+	uploadBytes.Observe(float64(meta.Size))
+	if meta.Size > profile.MaxPhotoBytes {
+		complaint := fmt.Sprintf("photos are limited to %d bytes each", profile.MaxPhotoBytes)
+		return profile.Photo{}, PhotoUploadError{Status: 413, Code: CodeTooLarge, Error: complaint}, errors.New("photo too large")
+	}
+	file, err := meta.Open()
+	if err != nil {
+		return profile.Photo{}, PhotoUploadError{Status: 500, Code: CodeInternal, Error: "file upload issue: p200"}, err
+	}
+	defer file.Close()
+
+	sniffed := make([]byte, 512)
+	n, err := io.ReadFull(file, sniffed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return profile.Photo{}, PhotoUploadError{Status: 400, Code: CodeInvalid, Error: "couldn't read that image; please upload a jpg, gif, or png"}, err
+	}
+	ctype := http.DetectContentType(sniffed[:n])
+	if !allowedPhotoTypes[ctype] {
+		return profile.Photo{}, PhotoUploadError{Status: 400, Code: CodeInvalid, Error: "please upload only an image file in jpg, gif, or png"}, errors.New("sniffed " + ctype)
+	}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return profile.Photo{}, PhotoUploadError{Status: 500, Code: CodeInternal, Error: "file upload issue: p200"}, err
+	}
+
+	photo := p.NewPhoto(caption)
+	_, err = photo.Create(ctx, p.Folder, file)
+	if err != nil {
+		switch {
+		case errors.Is(err, profile.ErrUnreadableImage):
+			return photo, PhotoUploadError{Status: 400, Code: CodeInvalid, Error: "couldn't read that image; please upload a jpg, gif, or png"}, err
+		case errors.Is(err, profile.ErrPhotoTooLarge):
+			complaint := fmt.Sprintf("photos are limited to %d by %d pixels, and %d pixels in all", profile.MaxPhotoEdge, profile.MaxPhotoEdge, profile.MaxPhotoPixels)
+			return photo, PhotoUploadError{Status: 413, Code: CodeTooLarge, Error: complaint}, err
+		case errors.Is(err, profile.ErrPhotoQuota):
+			complaint := fmt.Sprintf("profiles are limited to %d photos and %d bytes of storage", profile.MaxPhotos, profile.MaxPhotoStorage)
+			return photo, PhotoUploadError{Status: 413, Code: CodeQuotaExceeded, Error: complaint}, err
+		case errors.Is(err, context.DeadlineExceeded):
+			return photo, PhotoUploadError{Status: 504, Code: CodeTimeout, Error: "that took too long; please try again"}, err
+		case errors.Is(err, context.Canceled):
+			return photo, PhotoUploadError{Status: 503, Code: CodeUnavailable, Error: "request cancelled"}, err
+		}
+		return photo, PhotoUploadError{Status: 500, Code: CodeInternal, Error: "file upload issue: p244"}, err
 	}
+	return photo, PhotoUploadError{}, nil
 }
 
 /*
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RequestIdHeader carries the id of a request, which every error response repeats and
+// every log line about it includes.  Clients may send their own; otherwise we make one.
+const RequestIdHeader = "X-Request-Id"
+
+// Codes are the stable, machine-readable part of an ErrorResponse.  Clients should
+// match on these rather than on the Message, which is for people and may change.
+const (
+	CodeInvalid         = "invalid"
+	CodeUnauthenticated = "unauthenticated"
+	CodeForbidden       = "forbidden"
+	CodeSuspended       = "suspended"
+	CodeNotFound        = "not_found"
+	CodeDuplicate       = "duplicate"
+	CodeTooLarge        = "too_large"
+	CodeQuotaExceeded   = "quota_exceeded"
+	CodeRateLimited     = "rate_limited"
+	CodeInternal        = "internal"
+	CodeUnavailable     = "unavailable"
+	CodeTimeout         = "timeout"
+)
+
+// statusCodes gives the Code for errors which don't have a more specific one.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeInvalid,
+	http.StatusUnauthorized:          CodeUnauthenticated,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusConflict:              CodeDuplicate,
+	http.StatusRequestEntityTooLarge: CodeTooLarge,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusInternalServerError:   CodeInternal,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+	http.StatusGatewayTimeout:        CodeTimeout}
+
+// ErrorResponse is the body of every error status.  Fields, when present, maps the
+// names of request fields to what's wrong with each.
+type ErrorResponse struct {
+	Code      string
+	Message   string
+	Fields    map[string]string `json:",omitempty"`
+	RequestId string
+}
+
+// refusal is the error authenticate and requireRoles give to guard.
+type refusal struct {
+	status  int
+	code    string
+	message string
+}
+
+func (r refusal) Error() string {
+	return r.message
+}
+
+// codeFor returns the default Code for an HTTP status.
+func codeFor(status int) string {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	return CodeInternal
+}
+
+func error400(h http.Header, e string, addl ...interface{}) (int, http.Header, Response, error) {
+	return abort(h, http.StatusBadRequest, CodeInvalid, e, nil, addl)
+}
+
+// errorField is error400 for a problem with a single field of the request.
+func errorField(h http.Header, field, e string, addl ...interface{}) (int, http.Header, Response, error) {
+	return abort(h, http.StatusBadRequest, CodeInvalid, e, map[string]string{field: e}, addl)
+}
+
+func error401(h http.Header, e string, addl ...interface{}) (int, http.Header, Response, error) {
+	return abort(h, http.StatusUnauthorized, CodeUnauthenticated, e, nil, addl)
+}
+
+func error403(h http.Header, e string, addl ...interface{}) (int, http.Header, Response, error) {
+	return abort(h, http.StatusForbidden, CodeForbidden, e, nil, addl)
+}
+
+func error404(h http.Header, e string, addl ...interface{}) (int, http.Header, Response, error) {
+	return abort(h, http.StatusNotFound, CodeNotFound, e, nil, addl)
+}
+
+func error409(h http.Header, e string, addl ...interface{}) (int, http.Header, Response, error) {
+	return abort(h, http.StatusConflict, CodeDuplicate, e, nil, addl)
+}
+
+// error429 asks the client to wait before trying again, saying how long in Retry-After.
+func error429(h http.Header, wait time.Duration, e string, addl ...interface{}) (int, http.Header, Response, error) {
+	status, _, body, err := abort(h, http.StatusTooManyRequests, CodeRateLimited, e, nil, addl)
+	oh := http.Header{}
+	oh.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return status, oh, body, err
+}
+
+// error500 is also where cancelled profile calls end up, since callers pass along the
+// error; those get error503 or error504 instead, so clients know to try again.
+// Otherwise e, which names the failure for us, is only logged; the client gets the
+// request id to quote instead.
+func error500(h http.Header, e string, addl ...interface{}) (int, http.Header, Response, error) {
+	for _, val := range addl {
+		err, ok := val.(error)
+		if !ok {
+			continue
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return error504(h, "that took too long; please try again", append([]interface{}{e}, addl...)...)
+		} else if errors.Is(err, context.Canceled) {
+			return error503(h, "request cancelled", append([]interface{}{e}, addl...)...)
+		}
+	}
+	return abort(h, http.StatusInternalServerError, CodeInternal, "something went wrong on our end", nil, append([]interface{}{e}, addl...))
+}
+
+func error503(h http.Header, e string, addl ...interface{}) (int, http.Header, Response, error) {
+	return abort(h, http.StatusServiceUnavailable, CodeUnavailable, e, nil, addl)
+}
+
+func error504(h http.Header, e string, addl ...interface{}) (int, http.Header, Response, error) {
+	return abort(h, http.StatusGatewayTimeout, CodeTimeout, e, nil, addl)
+}
+
+// abort logs why a request failed and returns the ErrorResponse for tigertonic to send.
+// Failures which are our fault are errors; the rest are only worth noting.
+func abort(h http.Header, status int, code, message string, fields map[string]string, addl []interface{}) (int, http.Header, Response, error) {
+	level := slog.LevelInfo
+	if status >= 500 {
+		level = slog.LevelError
+	}
+	attrs := []interface{}{"status", status, "code", code}
+	if len(addl) > 0 {
+		attrs = append(attrs, "detail", strings.TrimSpace(fmt.Sprintln(addl...)))
+	}
+	logger(h).Log(context.Background(), level, message, attrs...)
+	return status, nil, ErrorResponse{code, message, fields, h.Get(RequestIdHeader)}, nil
+}
+
+// writeComplaint is abort for handlers which write their own responses.
+func writeComplaint(w http.ResponseWriter, r *http.Request, status int, complaint string, err error) {
+	writeError(w, r, status, codeFor(status), complaint, err)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, complaint string, err error) {
+	level := slog.LevelInfo
+	if status >= 500 {
+		level = slog.LevelError
+	}
+	attrs := []interface{}{"status", status, "code", code}
+	if err != nil {
+		attrs = append(attrs, "error", err)
+	}
+	logger(r.Header).Log(r.Context(), level, complaint, attrs...)
+	output, _ := json.Marshal(ErrorResponse{code, complaint, nil, r.Header.Get(RequestIdHeader)})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(output, '\n'))
+}
+
+// guard lets requests through to h only when test passes, and otherwise sends test's
+// refusal, which tigertonic.If would have sent in an envelope of its own.
+type guard struct {
+	test func(r *http.Request) error
+	h    http.Handler
+}
+
+func (g guard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := g.test(r)
+	if err == nil {
+		g.h.ServeHTTP(w, r)
+		return
+	}
+	var ref refusal
+	if errors.As(err, &ref) {
+		writeError(w, r, ref.status, ref.code, ref.message, nil)
+		return
+	}
+	writeComplaint(w, r, http.StatusInternalServerError, "something went wrong on our end", err)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/randallsquared/gochute/profile"
+)
+
+const (
+	defaultEventLimit = 100
+	maxEventLimit     = 1000
+)
+
+// record adds an Event to the log for the Profile with the given id (which may be nil
+// when we don't know who it was), noting which address the request came from.
+func record(h http.Header, id *int, kind profile.EventKind, details profile.Details) {
+	if details == nil {
+		details = profile.Details{}
+	}
+	if ip := clientAddress(h); ip != "" {
+		details["ip"] = ip
+	}
+	profile.Record(id, kind, details)
+}
+
+// ClientAddressHeader carries the client's address, as worked out by logged from the
+// connection and trustedProxies, to handlers, since tigertonic doesn't give them the
+// request itself.  Whatever a client sends in it is replaced.
+const ClientAddressHeader = "X-Chute-Client-Address"
+
+// trustedProxies are the proxies, set by -trusted-proxies, whose X-Forwarded-For we
+// believe.  With none, the address a request came from is the client's.
+var trustedProxies []netip.Prefix
+
+// setTrustedProxies parses a comma separated list of addresses and CIDR ranges into
+// trustedProxies.
+func setTrustedProxies(list string) error {
+	trustedProxies = nil
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return err
+			}
+			s = netip.PrefixFrom(addr, addr.BitLen()).String()
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return err
+		}
+		trustedProxies = append(trustedProxies, prefix.Masked())
+	}
+	return nil
+}
+
+func trusted(addr netip.Addr) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddress returns the address of the client which made r.  If the connection came
+// from a trusted proxy, X-Forwarded-For is read from the right, past any other trusted
+// proxies, to the first address one of them didn't add itself; anything to the left of
+// that came from the client and can't be believed.
+func remoteAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !trusted(addr) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for j := len(hops) - 1; j >= 0; j-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[j]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !trusted(addr) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+// clientAddress returns the client's address: the one the connection came from, or when
+// that was a trusted proxy, the one it gave in X-Forwarded-For.
+func clientAddress(h http.Header) string {
+	return h.Get(ClientAddressHeader)
+}
+
+// changedFields lists the names of the fields of a Profile which differ between before
+// and after, for the log; the values themselves are left out.
+func changedFields(before, after profile.Profile) []string {
+	fields := []struct {
+		name string
+		a, b interface{}
+	}{
+		{"Name", before.Name, after.Name},
+		{"Email", before.Email, after.Email},
+		{"Phone", before.Phone, after.Phone},
+		{"RateTypeId", before.RateTypeId, after.RateTypeId},
+		{"HourlyRate", before.HourlyRate, after.HourlyRate},
+		{"DailyRate", before.DailyRate, after.DailyRate},
+		{"RateUnits", before.RateUnits, after.RateUnits},
+		{"DisplayCurrency", before.DisplayCurrency, after.DisplayCurrency},
+		{"EmailVisibility", before.EmailVisibility, after.EmailVisibility},
+		{"PhoneVisibility", before.PhoneVisibility, after.PhoneVisibility},
+		{"Home", before.Home, after.Home},
+		{"TravelMiles", before.TravelMiles, after.TravelMiles},
+		{"Flags", before.Flags, after.Flags},
+		{"Utypes", before.Utypes, after.Utypes},
+		{"Attributes", before.Attributes, after.Attributes},
+	}
+	changed := []string{}
+	for _, f := range fields {
+		if !reflect.DeepEqual(f.a, f.b) {
+			changed = append(changed, f.name)
+		}
+	}
+	return changed
+}
+
+// eventFilter reads the kind, from, to and limit parameters common to both views of the
+// log, returning a complaint about the first one that doesn't make sense.
+func eventFilter(u *url.URL) (profile.EventFilter, string) {
+	q := u.Query()
+	f := profile.EventFilter{Limit: defaultEventLimit}
+	for _, k := range q["kind"] {
+		kind := profile.EventKind(k)
+		if !profile.EventKinds[kind] {
+			complaint := "'" + k + "' doesn't appear to be a valid event kind: "
+			complaint += strings.Join(profile.EventKindStrings(), ", ")
+			return f, complaint
+		}
+		f.Kinds = append(f.Kinds, kind)
+	}
+	for _, bound := range []struct {
+		name string
+		t    **time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		v := q.Get(bound.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, "'" + bound.name + "' must be an ISO-8601 timestamp"
+		}
+		*bound.t = &t
+	}
+	if l := q.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxEventLimit {
+			return f, "'limit' must be between 1 and " + strconv.Itoa(maxEventLimit)
+		}
+		f.Limit = limit
+	}
+	return f, ""
+}
+
+/*
+getEvents lets admins search the log.  Parameters, all optional:
+'profile': the id of the Profile the events are about.
+'kind': any number of profile.EventKinds.
+'from', 'to': ISO-8601 timestamps bounding when they happened.
+'limit': how many of the newest to return, by default 100.
+*/
+func getEvents(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	f, complaint := eventFilter(u)
+	if complaint != "" {
+		return error400(h, complaint, "bad event search")
+	}
+	if id := u.Query().Get("profile"); id != "" {
+		intId, err := strconv.Atoi(id)
+		if err != nil {
+			return error400(h, "'"+id+"' is not a valid Profile id.", "bad event search")
+		}
+		f.Profile = &intId
+	}
+	events, err := profile.GetEvents(c.Ctx, f)
+	if err != nil {
+		return error500(h, "db failure: v124", err)
+	}
+	return http.StatusOK, nil, events, nil
+}
+
+// getActivity is getEvents for the context Profile's own account activity.
+func getActivity(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	f, complaint := eventFilter(u)
+	if complaint != "" {
+		return error400(h, complaint, "bad activity search")
+	}
+	f.Profile = &c.Profile.Id
+	events, err := profile.GetEvents(c.Ctx, f)
+	if err != nil {
+		return error500(h, "db failure: v139", err)
+	}
+	return http.StatusOK, nil, events, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetTrustedProxies(t *testing.T) {
+	defer setTrustedProxies("")
+	tests := []struct {
+		list string
+		n    int
+		ok   bool
+	}{
+		{"", 0, true},
+		{"10.0.0.1", 1, true},
+		{"10.0.0.0/8, 192.168.1.7 ,::1", 3, true},
+		{"10.0.0.1,,", 1, true},
+		{"10.1.2.3/8", 1, true}, // masked to 10.0.0.0/8
+		{"proxy.example.com", 0, false},
+		{"10.0.0.0/33", 0, false},
+	}
+	for _, tt := range tests {
+		err := setTrustedProxies(tt.list)
+		if (err == nil) != tt.ok {
+			t.Errorf("setTrustedProxies(%q) gave error %v; want ok %v", tt.list, err, tt.ok)
+			continue
+		}
+		if tt.ok && len(trustedProxies) != tt.n {
+			t.Errorf("setTrustedProxies(%q) trusts %v; want %d entries", tt.list, trustedProxies, tt.n)
+		}
+	}
+}
+
+func TestRemoteAddress(t *testing.T) {
+	defer setTrustedProxies("")
+	tests := []struct {
+		name    string
+		trusted string
+		remote  string
+		xff     []string
+		want    string
+	}{
+		{"no proxies", "", "203.0.113.5:1234", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"untrusted proxy", "10.0.0.0/8", "203.0.113.5:1234", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"trusted proxy", "10.0.0.0/8", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy without the header", "10.0.0.0/8", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"spoofed left", "10.0.0.0/8", "10.0.0.1:1234", []string{"6.6.6.6, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "10.0.0.0/8", "10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"several headers", "10.0.0.0/8", "10.0.0.1:1234", []string{"6.6.6.6", "198.51.100.1"}, "198.51.100.1"},
+		{"nonsense", "10.0.0.0/8", "10.0.0.1:1234", []string{"198.51.100.1, nonsense"}, "10.0.0.1"},
+		{"all trusted", "10.0.0.0/8", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"ipv6", "::1", "[::1]:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		if err := setTrustedProxies(tt.trusted); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := remoteAddress(r); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
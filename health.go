@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/randallsquared/gochute/profile"
+)
+
+// readyTimeout bounds each of the checks getReady makes, so that a load balancer gets
+// an answer before it gives up on us.
+const readyTimeout = 5 * time.Second
+
+// Readiness says whether each thing we depend on is working: "ok" or "unavailable".
+type Readiness struct {
+	Database string
+	Storage  string
+}
+
+// getHealth only says that the process is up and serving; it doesn't touch anything we
+// depend on, so that a slow database doesn't get us restarted.
+func getHealth(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	return http.StatusOK, nil, struct{ Status string }{"ok"}, nil
+}
+
+// getReady checks the database and S3 at once, answering 503 unless both are working.
+// The reasons for failures are logged rather than returned, since anyone may ask.
+func getReady(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	ctx, cancel := context.WithTimeout(c.Ctx, readyTimeout)
+	defer cancel()
+	var (
+		wg              sync.WaitGroup
+		dbErr, storeErr error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		dbErr = profile.Ping(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		storeErr = profile.PingStorage(ctx)
+	}()
+	wg.Wait()
+
+	status := http.StatusOK
+	r := Readiness{"ok", "ok"}
+	if dbErr != nil {
+		logger(h).Warn("database not ready", "error", dbErr)
+		r.Database = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+	if storeErr != nil {
+		logger(h).Warn("storage not ready", "error", storeErr)
+		r.Storage = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+	return status, nil, r, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/randallsquared/go-tigertonic"
+	"github.com/randallsquared/gochute/profile"
+)
+
+// logLevel is set by -log-level; at debug, every SQL statement is logged too.
+var logLevel slog.LevelVar
+
+// Attributes with these names, or names containing the fragments, are never logged as
+// they are, wherever they turn up.
+var (
+	redactedKeys      = map[string]bool{"email": true, "phone": true, "authorization": true, "cookie": true, "set-cookie": true}
+	redactedFragments = []string{"token", "hash", "password", "secret"}
+	emailPattern      = regexp.MustCompile(`[^\s@'"<>]+@[^\s@'"<>]+\.[A-Za-z]{2,}`)
+)
+
+const redacted = "[redacted]"
+
+// setupLogging sends everything logged, through slog or the log package, to stderr as
+// JSON, at logLevel and above.
+func setupLogging() {
+	handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: &logLevel, ReplaceAttr: redact})
+	slog.SetDefault(slog.New(handler))
+	profile.TraceSQL(logLevel.Level() <= slog.LevelDebug)
+}
+
+// redact hides the values of sensitive attributes, and email addresses in any other
+// string, so that callers can't leak them by mistake.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	if redactedKeys[key] {
+		return slog.String(a.Key, redacted)
+	}
+	for _, fragment := range redactedFragments {
+		if strings.Contains(key, fragment) {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	if a.Value.Kind() == slog.KindString {
+		s := a.Value.String()
+		if emailPattern.MatchString(s) {
+			return slog.String(a.Key, emailPattern.ReplaceAllString(s, redacted))
+		}
+	}
+	return a
+}
+
+// logger returns the logger for the request with the given headers, which notes its id.
+func logger(h http.Header) *slog.Logger {
+	return slog.With("request", h.Get(RequestIdHeader))
+}
+
+// logged is the outermost handler: it gives each request an id, notes which address it
+// came from, and once it's done, logs how it went.  Ids from clients or proxies are kept
+// if they look sane, so that a request can be followed through every service it touches.
+type logged struct {
+	h http.Handler
+}
+
+func (l logged) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id := r.Header.Get(RequestIdHeader)
+	if !validRequestId(id) {
+		id = tigertonic.RandomBase62String(requestIdLength)
+		r.Header.Set(RequestIdHeader, id)
+	}
+	w.Header().Set(RequestIdHeader, id)
+	r.Header.Set(ClientAddressHeader, remoteAddress(r))
+	rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+	l.h.ServeHTTP(rec, r)
+
+	level := slog.LevelInfo
+	if rec.status >= 500 {
+		level = slog.LevelError
+	}
+	// the query string is left out, since searches may include contact details
+	logger(r.Header).Log(r.Context(), level, "handled",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"status", rec.status,
+		"bytes", rec.bytes,
+		"ms", time.Since(start).Milliseconds(),
+		"ip", clientAddress(r.Header))
+}
+
+// validRequestId accepts ids from clients or proxies only if they're short and plain
+// enough to put in logs and headers as they are.
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// recorder notes the status and size of a response for logged.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter, so that
+// streaming handlers can still flush.
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
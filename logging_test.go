@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		attr slog.Attr
+		want string
+	}{
+		{slog.String("email", "someone@example.com"), redacted},
+		{slog.String("Authorization", "Bearer abc"), redacted},
+		{slog.String("set-cookie", "session=abc"), redacted},
+		{slog.String("X-chute-token", "abc"), redacted},
+		{slog.String("passwordHash", "abc"), redacted},
+		{slog.Int("token", 12345), redacted},
+		{slog.String("detail", "no auth for someone@example.com, sorry"), "no auth for " + redacted + ", sorry"},
+		{slog.String("path", "/profiles/7"), "/profiles/7"},
+		{slog.String("detail", "an @ sign isn't an address"), "an @ sign isn't an address"},
+		{slog.Int("status", 500), "500"},
+	}
+	for _, tt := range tests {
+		got := redact(nil, tt.attr)
+		if got.Key != tt.attr.Key || got.Value.String() != tt.want {
+			t.Errorf("redact(%v) = %v; want %s=%s", tt.attr, got, tt.attr.Key, tt.want)
+		}
+	}
+}
+
+// TestRedactedLogs checks redact the way setupLogging uses it, including attributes in
+// groups and on loggers made With them.
+func TestRedactedLogs(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{ReplaceAttr: redact}))
+	log.With("phone", "555-0100").Info("signed up by someone@example.com",
+		slog.Group("request", "Cookie", "session=abc", "id", "xyz"))
+	out := buf.String()
+	for _, secret := range []string{"555-0100", "someone@example.com", "session=abc"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("%q was logged: %s", secret, out)
+		}
+	}
+	if !strings.Contains(out, `"id":"xyz"`) {
+		t.Errorf("the request id wasn't logged: %s", out)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/randallsquared/gochute/metrics"
+)
+
+var (
+	requests = metrics.NewCounter("chute_http_requests_total",
+		"Requests handled, by route and status.", "method", "route", "status")
+	requestDuration = metrics.NewHistogram("chute_http_request_duration_seconds",
+		"Time taken to handle requests, by route.", metrics.DefBuckets, "method", "route")
+	uploadBytes = metrics.NewHistogram("chute_photo_upload_bytes",
+		"Sizes of uploaded photo files, whether or not they were saved.", metrics.ExponentialBuckets(16<<10, 4, 8))
+	invitesCreated = metrics.NewCounter("chute_invites_created_total", "Invites created.")
+	logins         = metrics.NewCounter("chute_logins_total", "Login attempts, by result: succeeded, failed, suspended or throttled.", "result")
+	searches       = metrics.NewCounter("chute_searches_total", "Profile searches, by mode.", "mode")
+)
+
+// handle adds a route to mux, measured under its pattern rather than the URL, so that
+// there's one series per route rather than one per Profile.
+func handle(method, pattern string, h http.Handler) {
+	mux.Handle(method, pattern, measured{method, pattern, h})
+}
+
+// measured counts and times the requests for one route.
+type measured struct {
+	method string
+	route  string
+	h      http.Handler
+}
+
+func (m measured) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+	m.h.ServeHTTP(rec, r)
+	requestDuration.Observe(metrics.Since(start), m.method, m.route)
+	requests.Inc(m.method, m.route, strconv.Itoa(rec.status))
+}
@@ -0,0 +1,252 @@
+// Package metrics keeps counters and histograms in memory and serves them in the
+// Prometheus text format.  It does only what chute needs: every metric is registered
+// once, at startup, and labels are fixed when it's created.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefBuckets suit durations in seconds, from a few milliseconds to ten seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is anything that can write itself out for Handler.
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+var (
+	registryLock sync.Mutex
+	registry     []metric
+)
+
+func register(m metric) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	for _, r := range registry {
+		if r.name() == m.name() {
+			panic("metrics: " + m.name() + " registered twice")
+		}
+	}
+	registry = append(registry, m)
+}
+
+// ExponentialBuckets returns count buckets, the first being start and each after that
+// factor times the one before.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// Since returns the seconds since start, for Histogram.Observe.
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+// family is what Counters and Histograms have in common: a name, help text, label
+// names, and one series per distinct set of label values.
+type family struct {
+	n      string
+	help   string
+	labels []string
+	lock   sync.Mutex
+}
+
+func (f *family) name() string {
+	return f.n
+}
+
+// key joins label values for use as a map key.  The values must match the labels.
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.n, len(f.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelled renders label values, along with any extra pairs, as {a="x",b="y"}.
+func (f *family) labelled(key string, extra ...string) string {
+	var pairs []string
+	if len(f.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, f.labels[i]+`="`+escape(v)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escape(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (f *family) header(w *bufio.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.n, f.help, f.n, kind)
+}
+
+func escape(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+func format(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a total that only goes up, such as how many requests have been handled.
+type Counter struct {
+	family
+	values map[string]float64
+}
+
+// NewCounter registers a Counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{family{n: name, help: help, labels: labels}, map[string]float64{}}
+	register(c)
+	return c
+}
+
+// Inc adds one to the series with the given label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds n, which mustn't be negative, to the series with the given label values.
+func (c *Counter) Add(n float64, values ...string) {
+	key := c.key(values)
+	c.lock.Lock()
+	c.values[key] += n
+	c.lock.Unlock()
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.header(w, "counter")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.n, c.labelled(key), format(c.values[key]))
+	}
+}
+
+// Histogram counts observations, such as how long requests took, into buckets.
+type Histogram struct {
+	family
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a Histogram with the given upper bounds, in increasing order,
+// and label names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{family{n: name, help: help, labels: labels}, buckets, map[string]*histogramSeries{}}
+	register(h)
+	return h
+}
+
+// Observe adds v to the series with the given label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	key := h.key(values)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.header(w, "histogram")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.n, h.labelled(key, "le", format(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.n, h.labelled(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.n, h.labelled(key), format(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.n, h.labelled(key), s.count)
+	}
+}
+
+// funcMetric is a single value read when the metrics are served, such as the number of
+// open database connections.
+type funcMetric struct {
+	family
+	kind string
+	f    func() float64
+}
+
+// NewGaugeFunc registers a value which may go up or down, read from f when served.
+func NewGaugeFunc(name, help string, f func() float64) {
+	register(&funcMetric{family{n: name, help: help}, "gauge", f})
+}
+
+// NewCounterFunc registers a total kept elsewhere, read from f when served.
+func NewCounterFunc(name, help string, f func() float64) {
+	register(&funcMetric{family{n: name, help: help}, "counter", f})
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.header(w, m.kind)
+	fmt.Fprintf(w, "%s %s\n", m.n, format(m.f()))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Handler serves every registered metric in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryLock.Lock()
+		ms := append([]metric{}, registry...)
+		registryLock.Unlock()
+		sort.Slice(ms, func(i, j int) bool { return ms[i].name() < ms[j].name() })
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		out := bufio.NewWriter(w)
+		for _, m := range ms {
+			m.write(out)
+		}
+		out.Flush()
+	})
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// resetRegistry forgets every metric, so that each test starts with only its own.
+func resetRegistry() {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry = nil
+}
+
+func TestHandler(t *testing.T) {
+	resetRegistry()
+	requests := NewCounter("test_requests_total", "Requests, by method and route.", "method", "route")
+	requests.Inc("GET", "/a")
+	requests.Inc("GET", "/a")
+	requests.Add(0.5, "POST", `/b"c\d`)
+	durations := NewHistogram("test_duration_seconds", "Durations.", []float64{0.1, 1})
+	durations.Observe(0.05)
+	durations.Observe(0.1) // bounds are inclusive
+	durations.Observe(0.5)
+	durations.Observe(2)
+	NewGaugeFunc("test_open", "Open things.", func() float64 { return 3 })
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type is %q", ct)
+	}
+	// metrics are sorted by name, and series by label values
+	want := `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 2
+test_duration_seconds_bucket{le="1"} 3
+test_duration_seconds_bucket{le="+Inf"} 4
+test_duration_seconds_sum 2.65
+test_duration_seconds_count 4
+# HELP test_open Open things.
+# TYPE test_open gauge
+test_open 3
+# HELP test_requests_total Requests, by method and route.
+# TYPE test_requests_total counter
+test_requests_total{method="GET",route="/a"} 2
+test_requests_total{method="POST",route="/b\"c\\d"} 0.5
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	resetRegistry()
+	NewCounter("test_twice_total", "Registered twice.")
+	defer func() {
+		if recover() == nil {
+			t.Error("registering the same name twice didn't panic")
+		}
+	}()
+	NewCounter("test_twice_total", "Registered twice.")
+}
+
+func TestWrongLabels(t *testing.T) {
+	resetRegistry()
+	c := NewCounter("test_labels_total", "Takes one label.", "kind")
+	defer func() {
+		if recover() == nil {
+			t.Error("the wrong number of label values didn't panic")
+		}
+	}()
+	c.Inc()
+}
+
+func TestExponentialBuckets(t *testing.T) {
+	got := ExponentialBuckets(1, 2, 4)
+	want := []float64{1, 2, 4, 8}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
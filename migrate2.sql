@@ -18,3 +18,151 @@ alter table profile add column hourly integer not null default 0;
 alter table profile add column daily integer not null default 0;
 alter table profile add column rateunits char(3) not null default 'USD';
 
+
+ -- Oct 18, 2026
+
+-- photos uploaded from now on are stored as several renditions; older ones keep only the original
+alter table photo add column processed boolean not null default false;
+
+-- stored size of each photo, for per-profile storage quotas; older photos count as 0
+alter table photo add column bytes bigint not null default 0;
+
+-- photo ordering; existing photos keep upload order, and each profile's oldest is its avatar
+alter table photo add column sort integer not null default 0;
+alter table photo add column isprimary boolean not null default false;
+update photo set sort = ordered.n from (
+ select id, row_number() over (partition by profile order by id) - 1 as n from photo
+) ordered where photo.id = ordered.id;
+update photo set isprimary = true where sort = 0;
+
+-- lookups are retired rather than deleted; admins manage them through /admin
+alter table flag add column retired boolean not null default false;
+alter table utype add column retired boolean not null default false;
+alter table ratetype add column retired boolean not null default false;
+alter table profile add column admin boolean not null default false;
+
+-- admin becomes one of several roles; grant the first with: chute -grant-admin <profile id>
+alter table profile add column roles text not null default '';
+update profile set roles = 'admin' where admin;
+alter table profile drop column admin;
+
+-- abuse reports and moderation
+alter table profile add column suspended boolean not null default false;
+alter table photo add column hidden boolean not null default false;
+
+create table report (
+ id serial primary key,
+ reporter integer not null references profile (id),
+ kind varchar(40) not null,
+ subject integer not null,
+ reason varchar(40) not null,
+ details text not null default '',
+ created timestamp with time zone not null,
+ status varchar(40) not null,
+ assignee integer null references profile (id),
+ resolved timestamp with time zone,
+ resolution text
+);
+
+create table moderation (
+ id serial primary key,
+ moderator integer not null references profile (id),
+ action varchar(40) not null,
+ kind varchar(40) not null,
+ subject integer not null,
+ report integer null references report (id),
+ note text not null default '',
+ happened timestamp with time zone not null
+);
+
+-- ratings participants leave each other once an invite is over
+create table review (
+ id serial primary key,
+ invite integer not null references invite (id),
+ reviewer integer not null references profile (id),
+ reviewee integer not null references profile (id),
+ rating integer not null check (rating between 1 and 5),
+ body text not null default '',
+ created timestamp with time zone not null,
+ unique (invite, reviewer, reviewee)
+);
+create index review_reviewee on review (reviewee);
+
+-- who may see each contact detail: public, shared (with those sharing an invite) or private
+alter table profile add column emailvisibility varchar(40) not null default 'shared';
+alter table profile add column phonevisibility varchar(40) not null default 'shared';
+
+-- account deletion: purged by chute -purge-deleted once deleteafter passes
+alter table profile add column deleteafter timestamp with time zone;
+alter table profile add column deleted boolean not null default false;
+
+-- what profiles of each type may say about themselves; kind is text, number or choice
+create table attribute (
+ id serial primary key,
+ utype integer not null references utype (id),
+ name varchar(127) not null,
+ kind varchar(40) not null,
+ choices text not null default '[]', -- JSON list, for choice attributes
+ retired boolean not null default false,
+ unique (utype, name)
+);
+
+create table profile_attribute (
+ profile integer not null references profile (id),
+ attribute integer not null references attribute (id),
+ value text not null,
+ primary key (profile, attribute)
+);
+
+-- rates become minor units of an ISO 4217 currency: cents for USD, but yen for JPY
+update profile set rateunits = upper(trim(rateunits));
+-- anything that isn't a currency we know would fail every later profile update
+update profile set rateunits = 'USD' where rateunits not in (
+ 'AED', 'AFN', 'ALL', 'AMD', 'ANG', 'AOA', 'ARS', 'AUD', 'AWG', 'AZN', 'BAM', 'BBD',
+ 'BDT', 'BGN', 'BHD', 'BIF', 'BMD', 'BND', 'BOB', 'BRL', 'BSD', 'BTN', 'BWP', 'BYN',
+ 'BZD', 'CAD', 'CDF', 'CHF', 'CLP', 'CNY', 'COP', 'CRC', 'CUP', 'CVE', 'CZK', 'DJF',
+ 'DKK', 'DOP', 'DZD', 'EGP', 'ERN', 'ETB', 'EUR', 'FJD', 'FKP', 'GBP', 'GEL', 'GHS',
+ 'GIP', 'GMD', 'GNF', 'GTQ', 'GYD', 'HKD', 'HNL', 'HTG', 'HUF', 'IDR', 'ILS', 'INR',
+ 'IQD', 'IRR', 'ISK', 'JMD', 'JOD', 'JPY', 'KES', 'KGS', 'KHR', 'KMF', 'KPW', 'KRW',
+ 'KWD', 'KYD', 'KZT', 'LAK', 'LBP', 'LKR', 'LRD', 'LSL', 'LYD', 'MAD', 'MDL', 'MGA',
+ 'MKD', 'MMK', 'MNT', 'MOP', 'MRU', 'MUR', 'MVR', 'MWK', 'MXN', 'MYR', 'MZN', 'NAD',
+ 'NGN', 'NIO', 'NOK', 'NPR', 'NZD', 'OMR', 'PAB', 'PEN', 'PGK', 'PHP', 'PKR', 'PLN',
+ 'PYG', 'QAR', 'RON', 'RSD', 'RUB', 'RWF', 'SAR', 'SBD', 'SCR', 'SDG', 'SEK', 'SGD',
+ 'SHP', 'SLE', 'SOS', 'SRD', 'SSP', 'STN', 'SVC', 'SYP', 'SZL', 'THB', 'TJS', 'TMT',
+ 'TND', 'TOP', 'TRY', 'TTD', 'TWD', 'TZS', 'UAH', 'UGX', 'USD', 'UYU', 'UZS', 'VES',
+ 'VND', 'VUV', 'WST', 'XAF', 'XCD', 'XCG', 'XOF', 'XPF', 'YER', 'ZAR', 'ZMW', 'ZWG');
+update profile set hourly = 0 where hourly < 0;
+update profile set daily = 0 where daily < 0;
+-- rates which would no longer fit are capped rather than failing the migration
+update profile set hourly = least(hourly::bigint * 1000, 2147483647),
+  daily = least(daily::bigint * 1000, 2147483647)
+ where rateunits in ('BHD', 'IQD', 'JOD', 'KWD', 'LYD', 'OMR', 'TND');
+update profile set hourly = least(hourly::bigint * 100, 2147483647),
+  daily = least(daily::bigint * 100, 2147483647)
+ where rateunits not in ('BHD', 'IQD', 'JOD', 'KWD', 'LYD', 'OMR', 'TND',
+  'BIF', 'CLP', 'DJF', 'GNF', 'ISK', 'JPY', 'KMF', 'KRW', 'PYG', 'RWF', 'UGX', 'VND', 'VUV', 'XAF', 'XOF', 'XPF');
+alter table profile add constraint hourly_not_negative check (hourly >= 0);
+alter table profile add constraint daily_not_negative check (daily >= 0);
+alter table profile add column currency char(3);
+
+create table exchange (
+ currency char(3) primary key,
+ rate double precision not null check (rate > 0),
+ updated timestamp with time zone not null
+);
+
+-- where a profile is based, and how far it'll travel, for searches without free times
+alter table profile add column home point;
+alter table profile add column travel integer not null default 0 check (travel >= 0);
+
+-- invites can say where place is, for maps and distances
+alter table invite add column location point;
+alter table invite add column address text;
+
+-- the log table becomes the audit trail; event holds a JSON object of details
+alter table log add column kind varchar(40) not null default '';
+update log set event = '{}' where event is null;
+alter table log alter column event set default '{}';
+alter table log alter column event set not null;
+create index log_profile on log (profile, happened);
+create index log_happened on log (happened);
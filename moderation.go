@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/randallsquared/gochute/profile"
+)
+
+// NewReport is a complaint from the context Profile about a Profile, Photo or Message.
+type NewReport struct {
+	Kind    profile.ReportKind
+	Subject int
+	Reason  profile.Reason
+	Details string
+}
+
+// ReportAssignment gives a Report to a moderator; if Assignee is missing, it's the
+// context Profile.
+type ReportAssignment struct {
+	Assignee *int
+}
+
+// ReportResolution closes a Report.
+type ReportResolution struct {
+	Resolution string
+}
+
+// NewModeration is an Action taken by the context Profile, optionally while handling
+// a Report.
+type NewModeration struct {
+	Action  profile.Action
+	Subject int
+	Report  *int
+	Note    string
+}
+
+func report(u *url.URL, h http.Header, r *NewReport, c *Context) (int, http.Header, Response, error) {
+	if r == nil {
+		return error400(h, "no report provided")
+	}
+	if !profile.ReportKinds[r.Kind] {
+		return errorField(h, "Kind", "you can report a profile, photo, or message", "bad report kind")
+	}
+	if !profile.Reasons[r.Reason] {
+		complaint := "'" + string(r.Reason) + "' doesn't appear to be a valid reason: "
+		complaint += strings.Join(profile.ReasonStrings(), ", ")
+		return errorField(h, "Reason", complaint, "bad report reason")
+	}
+	ir := c.Profile.NewReport(r.Kind, r.Subject, r.Reason, r.Details)
+	err := ir.Create(c.Ctx)
+	if err != nil {
+		if errors.Is(err, profile.ErrNotFound) {
+			return error404(h, string(r.Kind)+" not found", err.Error())
+		}
+		return error500(h, "db failure: m56", err)
+	}
+	// reporters only need to know we got it
+	return http.StatusCreated, nil, struct{ Id int }{ir.Id}, nil
+}
+
+// findReport gets the Report named by {id} in the URL.
+func findReport(ctx context.Context, u *url.URL) (*profile.Report, func(http.Header, string, ...interface{}) (int, http.Header, Response, error), error) {
+	id := param(u, "id")
+	intId, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, error400, err
+	}
+	ir, err := profile.GetReport(ctx, intId)
+	if err != nil {
+		if errors.Is(err, profile.ErrNotFound) {
+			return nil, error404, err
+		}
+		return nil, error500, err
+	}
+	return ir, nil, nil
+}
+
+/*
+getReports is the moderation queue, pulling from the URL
+'status': the profile.ReportStatus to show (multiple specifications are ORed together);
+open and assigned Reports if missing.
+*/
+func getReports(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	var statuses []profile.ReportStatus
+	for _, s := range u.Query()["status"] {
+		status := profile.ReportStatus(s)
+		if !profile.ReportStatuses[status] {
+			return error400(h, "didn't understand '"+s+"' as a report status", s)
+		}
+		statuses = append(statuses, status)
+	}
+	if len(statuses) == 0 {
+		statuses = []profile.ReportStatus{profile.ReportOpen, profile.ReportAssigned}
+	}
+	rs, err := profile.GetReports(c.Ctx, statuses)
+	if err != nil {
+		return error500(h, "db failure: m99", err)
+	}
+	return http.StatusOK, nil, rs, nil
+}
+
+func assignReport(u *url.URL, h http.Header, a *ReportAssignment, c *Context) (int, http.Header, Response, error) {
+	ir, errType, err := findReport(c.Ctx, u)
+	if err != nil {
+		return errType(h, "report not found", err.Error())
+	}
+	assignee := c.Profile.Id
+	if a != nil && a.Assignee != nil {
+		assignee = *a.Assignee
+		ip, err := profile.GetProfile(c.Ctx, assignee)
+		if err != nil || !ip.Roles.Has(profile.RoleModerator) {
+			return errorField(h, "Assignee", "reports can only be assigned to moderators", "bad assignee")
+		}
+	}
+	err = ir.Assign(c.Ctx, c.Profile.Id, assignee)
+	if err != nil {
+		return error500(h, "db failure: m118", err)
+	}
+	return http.StatusOK, nil, ir, nil
+}
+
+func resolveReport(u *url.URL, h http.Header, r *ReportResolution, c *Context) (int, http.Header, Response, error) {
+	if r == nil || strings.TrimSpace(r.Resolution) == "" {
+		return errorField(h, "Resolution", "please say how the report was resolved")
+	}
+	ir, errType, err := findReport(c.Ctx, u)
+	if err != nil {
+		return errType(h, "report not found", err.Error())
+	}
+	err = ir.Resolve(c.Ctx, c.Profile.Id, r.Resolution)
+	if err != nil {
+		return error500(h, "db failure: m133", err)
+	}
+	return http.StatusOK, nil, ir, nil
+}
+
+func moderate(u *url.URL, h http.Header, m *NewModeration, c *Context) (int, http.Header, Response, error) {
+	if m == nil {
+		return error400(h, "no action provided")
+	}
+	if _, ok := profile.Actions[m.Action]; !ok {
+		complaint := "'" + string(m.Action) + "' doesn't appear to be a valid action: "
+		complaint += strings.Join(profile.ActionStrings(), ", ")
+		return errorField(h, "Action", complaint, "bad moderation action")
+	}
+	if m.Report != nil {
+		_, err := profile.GetReport(c.Ctx, *m.Report)
+		if err != nil {
+			return errorField(h, "Report", "'"+strconv.Itoa(*m.Report)+"' is not a valid Report id.", err.Error())
+		}
+	}
+	im, err := profile.Moderate(c.Ctx, c.Profile.Id, m.Action, m.Subject, m.Report, m.Note)
+	if err != nil {
+		if errors.Is(err, profile.ErrNotFound) {
+			return error404(h, "nothing to "+string(m.Action)+" with that id", err.Error())
+		} else if errors.Is(err, profile.ErrNotPermitted) {
+			return error403(h, "you can't suspend yourself, and only admins can suspend admins", err.Error())
+		}
+		return error500(h, "db failure: m157", err)
+	}
+	return http.StatusCreated, nil, im, nil
+}
+
+/*
+getModerations is the audit trail of moderator actions, pulling from the URL
+'kind': only actions on this profile.ReportKind.
+'subject': only actions on the thing with this id.
+*/
+func getModerations(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	var (
+		kind    *profile.ReportKind
+		subject *int
+	)
+	query := u.Query()
+	if k := query.Get("kind"); len(k) > 0 {
+		tmp := profile.ReportKind(k)
+		if !profile.ReportKinds[tmp] {
+			return error400(h, "didn't understand '"+k+"' as a kind", k)
+		}
+		kind = &tmp
+	}
+	if s := query.Get("subject"); len(s) > 0 {
+		tmp, err := strconv.Atoi(s)
+		if err != nil {
+			return error400(h, "didn't understand '"+s+"' as a subject id", err.Error())
+		}
+		subject = &tmp
+	}
+	ms, err := profile.GetModerations(c.Ctx, kind, subject)
+	if err != nil {
+		return error500(h, "db failure: m189", err)
+	}
+	return http.StatusOK, nil, ms, nil
+}
@@ -0,0 +1,277 @@
+package profile
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DeletionGrace is how long a Profile waits between asking to be deleted and being
+// purged, during which it can change its mind.
+var DeletionGrace = 14 * 24 * time.Hour
+
+// Export is everything we hold about a Profile, gathered so that it can be written out
+// as an archive.  Auths are included without their hashes or tokens, and Invites list
+// only who attended them, not anything else about those Profiles.
+type Export struct {
+	Profile   Profile
+	Auths     []Auth
+	Freetimes []Freetime
+	Invites   []ExportedInvite
+	Messages  []Message
+	Photos    []Photo
+	folder    string
+}
+
+// ExportedInvite is an Invite as it appears in an Export.
+type ExportedInvite struct {
+	Id        int
+	Organizer int
+	Active    bool
+	Start     time.Time
+	End       *time.Time
+	Created   time.Time
+	Place     string
+	Location  *Location
+	Address   *Address
+	Attendees []ExportedAttendee
+}
+
+// ExportedAttendee is an Attendee as it appears in an Export.
+type ExportedAttendee struct {
+	Profile int
+	Status  Status
+}
+
+// Export gathers everything about the receiver.  Nothing is fetched from S3 until the
+// Export is written.
+func (p *Profile) Export(ctx context.Context) (*Export, error) {
+	if err := ready(ctx); err != nil {
+		return nil, err
+	}
+	e := &Export{Profile: p.copy(), folder: p.Folder}
+	var err error
+	e.Auths, err = p.GetAuths(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for j := range e.Auths {
+		e.Auths[j].Hash = nil
+		e.Auths[j].Token = nil
+	}
+	e.Freetimes, err = p.GetFreetimes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	is := []Invite{}
+	iq := "select * from invite where organizer = $1 or id in (select invite from profile_invite where profile = $1) order by created asc"
+	_, err = dbmap.Select(&is, iq, p.Id)
+	if err != nil {
+		return nil, err
+	}
+	loaded := []*Invite{}
+	for j := range is {
+		loaded = append(loaded, &is[j])
+	}
+	err = loadInvites(dbmap, loaded)
+	if err != nil {
+		return nil, err
+	}
+	e.Invites = []ExportedInvite{}
+	for _, i := range is {
+		ei := ExportedInvite{i.Id, i.Organizer, i.Active, i.Start, i.End, i.Created, i.Place, i.Location, i.Address, []ExportedAttendee{}}
+		for _, a := range i.Attendees {
+			ei.Attendees = append(ei.Attendees, ExportedAttendee{a.Id, a.Status})
+		}
+		e.Invites = append(e.Invites, ei)
+	}
+
+	e.Messages = []Message{}
+	_, err = dbmap.Select(&e.Messages, "select * from message where sender = $1 order by sent asc", p.Id)
+	if err != nil {
+		return nil, err
+	}
+	// moderators may have hidden some Photos, but they're still the Profile's own
+	e.Photos = []Photo{}
+	_, err = dbmap.Select(&e.Photos, "select * from photo where profile = $1 order by sort asc, id asc", p.Id)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// WriteZip writes the Export as a zip archive: a JSON file for each part, and the full
+// size file of each Photo under photos/.
+func (e *Export) WriteZip(ctx context.Context, w io.Writer) error {
+	z := zip.NewWriter(w)
+	parts := []struct {
+		name string
+		v    interface{}
+	}{
+		{"profile.json", e.Profile},
+		{"auths.json", e.Auths},
+		{"freetimes.json", e.Freetimes},
+		{"invites.json", e.Invites},
+		{"messages.json", e.Messages},
+		{"photos.json", e.Photos},
+	}
+	for _, part := range parts {
+		f, err := z.Create(part.name)
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(part.v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	b := s3Photos.Bucket(BaseBucket + "/" + e.folder)
+	for _, ph := range e.Photos {
+		var data []byte
+		err := stored(ctx, "get", func() error {
+			var err error
+			data, err = b.Get(ph.key(RenditionFull))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		f, err := z.Create("photos/" + strconv.Itoa(ph.Id) + photoExtension(data))
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+// photoExtension guesses a file extension for the image in data.
+func photoExtension(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/jpeg":
+		return ".jpg"
+	}
+	return ""
+}
+
+// RequestDeletion schedules the receiver to be purged once DeletionGrace has passed.
+// Until then it can still log in, and CancelDeletion undoes this.
+func (p *Profile) RequestDeletion(ctx context.Context) error {
+	if err := ready(ctx); err != nil {
+		return err
+	}
+	after := time.Now().Add(DeletionGrace)
+	_, err := dbmap.Exec("update profile set deleteafter = $1, updated = now() where id = $2", after, p.Id)
+	if err != nil {
+		return err
+	}
+	p.DeleteAfter = &after
+	forgetProfile(p.Id)
+	return nil
+}
+
+// CancelDeletion keeps the receiver from being purged after all.
+func (p *Profile) CancelDeletion(ctx context.Context) error {
+	if err := ready(ctx); err != nil {
+		return err
+	}
+	_, err := dbmap.Exec("update profile set deleteafter = null, updated = now() where id = $1 and not deleted", p.Id)
+	if err != nil {
+		return err
+	}
+	p.DeleteAfter = nil
+	forgetProfile(p.Id)
+	return nil
+}
+
+// PurgeDeleted purges every Profile whose DeletionGrace has passed, returning how many
+// were purged.  It stops at the first failure; anything not purged is tried again the
+// next time.
+func PurgeDeleted(ctx context.Context) (int, error) {
+	ps := []Profile{}
+	_, err := dbmap.Select(&ps, "select * from profile where deleteafter < now() and not deleted")
+	if err != nil {
+		return 0, err
+	}
+	for n := range ps {
+		err = ps[n].purge(ctx)
+		if err != nil {
+			return n, err
+		}
+	}
+	return len(ps), nil
+}
+
+// purge removes everything about the receiver except the row itself, which is kept with
+// nothing identifying left in it, so that Messages others can still see have a sender.
+// Organized Invites are cancelled, Photos are removed from S3, the usernames and
+// addresses in its log entries are cleared, and the rest is deleted.
+func (p *Profile) purge(ctx context.Context) error {
+	if err := ready(ctx); err != nil {
+		return err
+	}
+	photos := []Photo{}
+	_, err := dbmap.Select(&photos, "select * from photo where profile = $1", p.Id)
+	if err != nil {
+		return err
+	}
+
+	steps := []string{
+		"update message set photo = null where photo in (select id from photo where profile = $1)",
+		"delete from photo where profile = $1",
+		"update invite set active = false where organizer = $1",
+		"delete from profile_invite where profile = $1",
+		"delete from free where profile = $1",
+		"delete from profile_flag where profile = $1",
+		"delete from profile_utype where profile = $1",
+		"delete from profile_attribute where profile = $1",
+		"delete from review where reviewer = $1 or reviewee = $1",
+		// the log keeps what happened, but not who from where
+		`update log set event = (event::jsonb - 'ip' - 'username')::text
+		  where profile = $1 or (profile is null and
+		    event::jsonb->>'username' in (select username from auth where profile = $1))`,
+		"delete from auth where profile = $1",
+		`update profile set email = null, phone = null, name = null, hourly = 0, daily = 0,
+		  roles = '', emailvisibility = 'private', phonevisibility = 'private', home = null, travel = 0,
+		  deleted = true, updated = now() where id = $1`,
+	}
+	err = InTransaction(ctx, func(t *Tx) error {
+		for _, q := range steps {
+			_, err := t.executor().Exec(q, p.Id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	forgetProfile(p.Id)
+
+	// the rows are gone, so any files left behind will be found by Reconcile
+	b := s3Photos.Bucket(BaseBucket + "/" + p.Folder)
+	for j := range photos {
+		photos[j].removeObjects(b)
+	}
+	slog.Info("purged profile", "profile", p.Id)
+	return nil
+}
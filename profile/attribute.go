@@ -0,0 +1,258 @@
+package profile
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/coopernurse/gorp"
+)
+
+// AttributeKind is the type of value an Attribute holds.
+type AttributeKind string
+
+const (
+	KindText   AttributeKind = "text"
+	KindNumber AttributeKind = "number"
+	KindChoice AttributeKind = "choice"
+)
+
+// MaxAttributeLength is the longest value a text Attribute may have.
+const MaxAttributeLength = 1000
+
+var AttributeKinds map[AttributeKind]bool = map[AttributeKind]bool{
+	KindText:   true,
+	KindNumber: true,
+	KindChoice: true}
+
+// Attribute is something Profiles of one Utype may say about themselves, such as a
+// Model's height or a Photographer's gear.  Like the other lookups, Attributes are
+// Retired rather than deleted, and their Kind can't change once created.
+type Attribute struct {
+	Id      int
+	Utype   int // Utype
+	Name    string
+	Kind    AttributeKind
+	Choices Choices // only for KindChoice
+	Retired bool
+}
+
+// Choices are the allowed values of a choice Attribute, stored as a JSON list since a
+// choice may well have a comma in it.
+type Choices []string
+
+// AttributeValue is a Profile's value for an Attribute.
+type AttributeValue struct {
+	Attribute int
+	Value     string
+}
+
+// AttributeFilter narrows a Search to Profiles with an Attribute value equal to Value,
+// or for number Attributes, between Min and Max; any of the three may be missing.
+type AttributeFilter struct {
+	Attribute int
+	Value     *string
+	Min       *float64
+	Max       *float64
+}
+
+// attributeConnector is a connector for getting the AttributeValues of several Profiles at once.
+type attributeConnector struct {
+	Connector int
+	AttributeValue
+}
+
+// Scan exists only to convert from the SQL result of a JSON list to Choices.
+func (cs *Choices) Scan(src interface{}) error {
+	var list []byte
+	switch src := src.(type) {
+	default:
+		return errors.New(fmt.Sprintf("unexpected type %T", src))
+	case nil:
+		*cs = Choices{}
+		return nil
+	case string:
+		list = []byte(src)
+	case []uint8:
+		list = src
+	}
+	*cs = Choices{}
+	return json.Unmarshal(list, cs)
+}
+
+// Value converts Choices back to the JSON list we store.
+func (cs Choices) Value() (driver.Value, error) {
+	if cs == nil {
+		cs = Choices{}
+	}
+	list, err := json.Marshal(cs)
+	return string(list), err
+}
+
+// GetAttributes returns the Attributes of all possible Utypes (cached), leaving out those
+// Retired.
+func GetAttributes(ctx context.Context) ([]Attribute, error) {
+	l, err := cachedLookups(ctx)
+	as := []Attribute{}
+	for _, a := range l.attributes {
+		if !a.Retired {
+			as = append(as, a)
+		}
+	}
+	return as, err
+}
+
+// AllAttributes returns every Attribute, including those Retired.
+func AllAttributes(ctx context.Context) ([]Attribute, error) {
+	l, err := cachedLookups(ctx)
+	return append([]Attribute{}, l.attributes...), err
+}
+
+// Create saves a new Attribute.
+func (a *Attribute) Create(ctx context.Context) error {
+	if err := ready(ctx); err != nil {
+		return err
+	}
+	defer InvalidateLookups()
+	return dbmap.Insert(a)
+}
+
+// Save saves an Attribute, which may be renamed, given new Choices, or Retired.
+func (a *Attribute) Save(ctx context.Context) error {
+	if err := ready(ctx); err != nil {
+		return err
+	}
+	defer InvalidateLookups()
+	return saveOne(dbmap.Update(a))
+}
+
+// Check returns a complaint if v isn't a suitable value for the Attribute, or "" if it is.
+func (a *Attribute) Check(v string) string {
+	switch a.Kind {
+	case KindNumber:
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			return "'" + a.Name + "' must be a number"
+		}
+	case KindChoice:
+		for _, c := range a.Choices {
+			if c == v {
+				return ""
+			}
+		}
+		return "'" + a.Name + "' must be one of: " + strings.Join(a.Choices, ", ")
+	default:
+		if len(v) > MaxAttributeLength {
+			return "'" + a.Name + "' must be " + strconv.Itoa(MaxAttributeLength) + " characters or less"
+		}
+	}
+	return ""
+}
+
+// CheckAttributes returns a complaint about the first of vs which isn't a suitable value
+// of a current Attribute of one of the receiver's Utypes, or "" if they all are.
+func (p *Profile) CheckAttributes(ctx context.Context, vs []AttributeValue) (string, error) {
+	all, err := GetAttributes(ctx)
+	if err != nil {
+		return "", err
+	}
+	byId := map[int]Attribute{}
+	for _, a := range all {
+		byId[a.Id] = a
+	}
+	mine := map[int]bool{}
+	for _, t := range p.Utypes {
+		mine[t.Id] = true
+	}
+	seen := map[int]bool{}
+	for _, v := range vs {
+		a, ok := byId[v.Attribute]
+		if !ok {
+			return "'" + strconv.Itoa(v.Attribute) + "' is not a valid attribute id", nil
+		}
+		if !mine[a.Utype] {
+			return "'" + a.Name + "' is not an attribute of any of your types", nil
+		}
+		if seen[a.Id] {
+			return "'" + a.Name + "' can only be given once", nil
+		}
+		seen[a.Id] = true
+		if complaint := a.Check(v.Value); complaint != "" {
+			return complaint, nil
+		}
+	}
+	return "", nil
+}
+
+// saveAttributes replaces the AttributeValues of the receiver.
+func (p *Profile) saveAttributes(s gorp.SqlExecutor) error {
+	_, err := s.Exec("delete from profile_attribute where profile = $1", p.Id)
+	if err != nil {
+		return err
+	}
+	for _, v := range p.Attributes {
+		_, err = s.Exec("insert into profile_attribute values ($1, $2, $3)", p.Id, v.Attribute, v.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attributeFilters adds a condition for each of fs to a Search query, using params for
+// the values.
+func attributeFilters(fs []AttributeFilter, params map[string]interface{}) string {
+	q := ""
+	for _, f := range fs {
+		n := token()
+		params[n] = f.Attribute
+		conds := []string{"attribute = :" + n}
+		if f.Value != nil {
+			v := token()
+			params[v] = *f.Value
+			conds = append(conds, "value = :"+v)
+		}
+		// the case keeps us from casting values of other Attributes, which may not be numbers
+		number := "case when attribute = :" + n + " then cast(value as double precision) end"
+		if f.Min != nil {
+			v := token()
+			params[v] = *f.Min
+			conds = append(conds, number+" >= :"+v)
+		}
+		if f.Max != nil {
+			v := token()
+			params[v] = *f.Max
+			conds = append(conds, number+" <= :"+v)
+		}
+		q += "\nand profile.id in (select profile from profile_attribute where " + strings.Join(conds, " and ") + ")\n"
+	}
+	return q
+}
+
+// PruneAttributes drops any AttributeValues which don't belong to one of the receiver's
+// Utypes, as happens when a Profile stops being one of them.  It does not save.
+func (p *Profile) PruneAttributes(ctx context.Context) error {
+	all, err := AllAttributes(ctx)
+	if err != nil {
+		return err
+	}
+	utypeOf := map[int]int{}
+	for _, a := range all {
+		utypeOf[a.Id] = a.Utype
+	}
+	mine := map[int]bool{}
+	for _, t := range p.Utypes {
+		mine[t.Id] = true
+	}
+	kept := []AttributeValue{}
+	for _, v := range p.Attributes {
+		if mine[utypeOf[v.Attribute]] {
+			kept = append(kept, v)
+		}
+	}
+	p.Attributes = kept
+	return nil
+}
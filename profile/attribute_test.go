@@ -0,0 +1,42 @@
+package profile
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAttributeCheck(t *testing.T) {
+	height := Attribute{Name: "Height", Kind: KindNumber}
+	hair := Attribute{Name: "Hair", Kind: KindChoice, Choices: Choices{"black", "brown, dark", "red"}}
+	gear := Attribute{Name: "Gear", Kind: KindText}
+	tests := []struct {
+		a  Attribute
+		v  string
+		ok bool
+	}{
+		{height, "170", true},
+		{height, "-1.5", true},
+		{height, "1e3", true},
+		{height, "tall", false},
+		{height, "", false},
+		{height, "170cm", false},
+		{hair, "red", true},
+		{hair, "brown, dark", true},
+		{hair, "Red", false}, // choices are exact
+		{hair, "brown", false},
+		{hair, "", false},
+		{gear, "", true},
+		{gear, "a camera, and lights", true},
+		{gear, strings.Repeat("x", MaxAttributeLength), true},
+		{gear, strings.Repeat("x", MaxAttributeLength+1), false},
+	}
+	for _, tt := range tests {
+		complaint := tt.a.Check(tt.v)
+		if (complaint == "") != tt.ok {
+			t.Errorf("%s.Check(%.20q) = %q; want ok %v", tt.a.Name, tt.v, complaint, tt.ok)
+		}
+		if complaint != "" && !strings.Contains(complaint, tt.a.Name) {
+			t.Errorf("%s.Check(%.20q) = %q, which doesn't say which attribute", tt.a.Name, tt.v, complaint)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package profile
+
+import (
+	"context"
+
+	"github.com/coopernurse/gorp"
+)
+
+// attendeeConnector is a connector for getting the Attendees of several Invites at once.
+type attendeeConnector struct {
+	Connector int
+	Status    Status
+	Profile
+}
+
+// inList appends ids to params and returns the bind variables for them as a SQL list,
+// such as "($3,$4)".
+func inList(params []interface{}, ids []int) (string, []interface{}) {
+	list := "("
+	for i, id := range ids {
+		params = append(params, id)
+		if i > 0 {
+			list += ","
+		}
+		list += bindVarFor(params)
+	}
+	return list + ")", params
+}
+
+// uniqueIds drops duplicates from ids, keeping the first of each.
+func uniqueIds(ids []int) []int {
+	seen := map[int]bool{}
+	out := []int{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// loadProfileDetails does for all of ps what PostGet does for a single Profile, in
+// three queries rather than three per Profile.
+func loadProfileDetails(s gorp.SqlExecutor, ps []*Profile) error {
+	if len(ps) == 0 {
+		return nil
+	}
+	var ids []int
+	byId := map[int][]*Profile{}
+	for _, p := range ps {
+		p.Flags = []Flag{}
+		p.Utypes = []Utype{}
+		p.Attributes = []AttributeValue{}
+		ids = append(ids, p.Id)
+		byId[p.Id] = append(byId[p.Id], p)
+	}
+	list, params := inList(nil, uniqueIds(ids))
+
+	flags := []FlagConnector{}
+	fq := "select profile as connector, flag.* from flag inner join profile_flag on (flag = id) where profile in " + list
+	_, err := s.Select(&flags, fq, params...)
+	if err != nil {
+		return err
+	}
+	for _, f := range flags {
+		for _, p := range byId[f.Connector] {
+			p.Flags = append(p.Flags, f.Flag)
+		}
+	}
+
+	types := []UtypeConnector{}
+	tq := "select profile as connector, utype.* from utype inner join profile_utype on (utype = id) where profile in " + list
+	_, err = s.Select(&types, tq, params...)
+	if err != nil {
+		return err
+	}
+	for _, t := range types {
+		for _, p := range byId[t.Connector] {
+			p.Utypes = append(p.Utypes, t.Utype)
+		}
+	}
+
+	attrs := []attributeConnector{}
+	aq := "select profile as connector, attribute, value from profile_attribute where profile in " + list + " order by attribute asc"
+	_, err = s.Select(&attrs, aq, params...)
+	if err != nil {
+		return err
+	}
+	for _, a := range attrs {
+		for _, p := range byId[a.Connector] {
+			p.Attributes = append(p.Attributes, a.AttributeValue)
+		}
+	}
+	return nil
+}
+
+// loadInvites does for all of is what PostGet does for a single Invite: three queries
+// for all the Attendees and one for all the Messages, however many Invites there are.
+func loadInvites(s gorp.SqlExecutor, is []*Invite) error {
+	if len(is) == 0 {
+		return nil
+	}
+	var ids []int
+	byId := map[int]*Invite{}
+	for _, i := range is {
+		i.Attendees = []Attendee{}
+		i.Messages = []Message{}
+		ids = append(ids, i.Id)
+		byId[i.Id] = i
+	}
+	list, params := inList(nil, uniqueIds(ids))
+
+	atts := []attendeeConnector{}
+	aq := "select invite as connector, status, profile.* from profile inner join profile_invite on (profile = id) where invite in " + list
+	_, err := s.Select(&atts, aq, params...)
+	if err != nil {
+		return err
+	}
+	ps := []*Profile{}
+	for j := range atts {
+		ps = append(ps, &atts[j].Profile)
+	}
+	err = loadProfileDetails(s, ps)
+	if err != nil {
+		return err
+	}
+	for _, a := range atts {
+		i := byId[a.Connector]
+		i.Attendees = append(i.Attendees, Attendee{a.Profile, a.Status})
+	}
+
+	ms := []Message{}
+	mq := "select * from message where invite in " + list + " order by id asc"
+	_, err = s.Select(&ms, mq, params...)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		i := byId[m.Invite]
+		i.Messages = append(i.Messages, m)
+	}
+	return nil
+}
+
+// GetProfiles returns the Profiles with the given ids, keyed by id, with their Flags and
+// Utypes.  Ids with no Profile are simply missing from the result.
+func GetProfiles(ctx context.Context, ids []int) (map[int]*Profile, error) {
+	if err := ready(ctx); err != nil {
+		return nil, err
+	}
+	out := map[int]*Profile{}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	list, params := inList(nil, uniqueIds(ids))
+	ps := []Profile{}
+	_, err := dbmap.Select(&ps, "select * from profile where id in "+list, params...)
+	if err != nil {
+		return nil, err
+	}
+	loaded := []*Profile{}
+	for j := range ps {
+		loaded = append(loaded, &ps[j])
+		out[ps[j].Id] = &ps[j]
+	}
+	return out, loadProfileDetails(dbmap, loaded)
+}
+
+// GetPhotos returns the Photos with the given ids, keyed by id.  Ids with no Photo, or
+// whose Photo is Hidden, are simply missing from the result.
+func GetPhotos(ctx context.Context, ids []int) (map[int]*Photo, error) {
+	if err := ready(ctx); err != nil {
+		return nil, err
+	}
+	out := map[int]*Photo{}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	list, params := inList(nil, uniqueIds(ids))
+	ps := []Photo{}
+	_, err := dbmap.Select(&ps, "select * from photo where not hidden and id in "+list, params...)
+	if err != nil {
+		return nil, err
+	}
+	for j := range ps {
+		out[ps[j].Id] = &ps[j]
+	}
+	return out, nil
+}
+
+// GetPhotosByProfile returns the Photos of each of the given Profile ids, in the same
+// order as Profile.Photos, and likewise leaving out those Hidden.
+func GetPhotosByProfile(ctx context.Context, ids []int) (map[int][]Photo, error) {
+	if err := ready(ctx); err != nil {
+		return nil, err
+	}
+	out := map[int][]Photo{}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	list, params := inList(nil, uniqueIds(ids))
+	ps := []Photo{}
+	q := "select * from photo where not hidden and profile in " + list + " order by isprimary desc, sort asc, id asc"
+	_, err := dbmap.Select(&ps, q, params...)
+	if err != nil {
+		return nil, err
+	}
+	for _, photo := range ps {
+		out[photo.Profile] = append(out[photo.Profile], photo)
+	}
+	return out, nil
+}
@@ -0,0 +1,165 @@
+package profile
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// CacheTTL bounds how stale anything we cache can be.  Everything cached is also dropped
+// explicitly when we change it, so this only matters when something else (another
+// process, or someone in psql) changes the database behind our backs.
+var CacheTTL = 5 * time.Minute
+
+// session is what we cache for a logged in token: the Auth and its Profile.
+type session struct {
+	auth    Auth
+	profile Profile
+	expires time.Time
+}
+
+// lookups is what we cache of the tables which hardly ever change.
+type lookups struct {
+	flags         []Flag
+	utypes        []Utype
+	rateTypes     []RateType
+	attributes    []Attribute
+	exchangeRates []ExchangeRate
+	expires       time.Time
+}
+
+// Each generation is bumped whenever we forget something, so that a load which started
+// before the forgetting doesn't put stale data back afterward.
+var (
+	cacheLock         sync.Mutex
+	sessions          map[string]*session = map[string]*session{}
+	sessionGeneration int
+	lookup            lookups
+	lookupGeneration  int
+)
+
+// GetSession returns the Auth and Profile for a logged in token, from the cache when it
+// can.  The results are copies, so callers are free to change them.  Tokens for
+// suspended Profiles are refused with ErrSuspended.
+func GetSession(ctx context.Context, token string) (*Auth, *Profile, error) {
+	now := time.Now()
+	cacheLock.Lock()
+	s := sessions[token]
+	if s != nil && now.Before(s.expires) {
+		a, p := s.auth, s.profile.copy()
+		cacheLock.Unlock()
+		p.Auth = &a
+		return &a, &p, nil
+	}
+	generation := sessionGeneration
+	cacheLock.Unlock()
+
+	a := new(Auth)
+	a.Token = &token
+	err := a.Get(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := new(Profile)
+	err = p.Get(ctx, a)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.Suspended {
+		return nil, nil, ErrSuspended
+	}
+
+	cacheLock.Lock()
+	if generation == sessionGeneration {
+		sessions[token] = &session{*a, p.copy(), now.Add(CacheTTL)}
+	}
+	cacheLock.Unlock()
+	return a, p, nil
+}
+
+// copy returns a Profile which shares nothing with the receiver that either could change.
+func (p Profile) copy() Profile {
+	p.Auth = nil
+	p.Flags = append([]Flag{}, p.Flags...)
+	p.Utypes = append([]Utype{}, p.Utypes...)
+	p.Roles = append(Roles{}, p.Roles...)
+	p.Attributes = append([]AttributeValue{}, p.Attributes...)
+	return p
+}
+
+// forgetSessions drops every cached session matching f.
+func forgetSessions(f func(*session) bool) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	sessionGeneration++
+	for token, s := range sessions {
+		if f(s) {
+			delete(sessions, token)
+		}
+	}
+}
+
+// forgetAuth drops cached sessions for an Auth, which must be done whenever its token,
+// Profile, or anything else about it changes.
+func forgetAuth(id int) {
+	forgetSessions(func(s *session) bool { return s.auth.Id == id })
+}
+
+// forgetProfile drops cached sessions for every Auth of a Profile.
+func forgetProfile(id int) {
+	forgetSessions(func(s *session) bool { return s.profile.Id == id || s.auth.Profile == id })
+}
+
+// InvalidateLookups drops the cached Flags, Utypes, RateTypes, Attributes and
+// ExchangeRates, so that changes to them show up right away.
+func InvalidateLookups() {
+	cacheLock.Lock()
+	lookup = lookups{}
+	lookupGeneration++
+	cacheLock.Unlock()
+}
+
+// cachedLookups returns the cached lookup tables, loading all of them if any has expired.
+func cachedLookups(ctx context.Context) (lookups, error) {
+	now := time.Now()
+	cacheLock.Lock()
+	current := lookup
+	generation := lookupGeneration
+	cacheLock.Unlock()
+	if now.Before(current.expires) {
+		return current, nil
+	}
+	if err := ready(ctx); err != nil {
+		return current, err
+	}
+
+	var fresh lookups
+	_, err := dbmap.Select(&fresh.flags, "select * from flag order by id asc")
+	if err != nil {
+		return fresh, err
+	}
+	_, err = dbmap.Select(&fresh.utypes, "select * from utype order by id asc")
+	if err != nil {
+		return fresh, err
+	}
+	_, err = dbmap.Select(&fresh.rateTypes, "select * from ratetype order by sort asc")
+	if err != nil {
+		return fresh, err
+	}
+	_, err = dbmap.Select(&fresh.attributes, "select * from attribute order by utype asc, id asc")
+	if err != nil {
+		return fresh, err
+	}
+	_, err = dbmap.Select(&fresh.exchangeRates, "select * from exchange order by currency asc")
+	if err != nil {
+		return fresh, err
+	}
+	fresh.expires = now.Add(CacheTTL)
+
+	cacheLock.Lock()
+	if generation == lookupGeneration {
+		lookup = fresh
+	}
+	cacheLock.Unlock()
+	return fresh, nil
+}
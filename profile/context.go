@@ -0,0 +1,135 @@
+package profile
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coopernurse/gorp"
+	"github.com/randallsquared/gochute/metrics"
+)
+
+// QueryTimeout bounds the listings which may scan a lot of rows, such as Invites and the
+// log; SearchTimeout bounds Search and SearchTravelling; StorageTimeout bounds each call
+// to S3.  These apply within whatever deadline the caller's Context already has.
+var (
+	QueryTimeout   = 10 * time.Second
+	SearchTimeout  = 15 * time.Second
+	StorageTimeout = 30 * time.Second
+)
+
+// gorp can't be handed a Context, so every function here which goes to the database or
+// S3 takes one and checks it with ready before starting.  The queries which might run
+// long go through cancellable instead, which stops them on the server.
+
+// ready returns the Context's error if it's already done, so that we don't start work
+// nobody is waiting for.
+func ready(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// cancellable runs f in a transaction which PostgreSQL cancels if ctx is done before f
+// is, and which can't run past timeout in any case.  Cancellation is reported as the
+// Context's error, context.DeadlineExceeded or context.Canceled.  It costs a few round
+// trips, so it's only for queries that might take a while.
+func cancellable(ctx context.Context, timeout time.Duration, f func(s gorp.SqlExecutor) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := ready(ctx); err != nil {
+		return err
+	}
+	tx, err := dbmap.Begin()
+	if err != nil {
+		return err
+	}
+	err = limit(ctx, tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	pid, err := tx.SelectInt("select pg_backend_pid()")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// the watcher must be finished before the connection goes back to the pool, or it
+	// might cancel whatever the next user of that connection is doing
+	done := make(chan struct{})
+	var watcher sync.WaitGroup
+	watcher.Add(1)
+	go func() {
+		defer watcher.Done()
+		select {
+		case <-ctx.Done():
+			dbmap.Exec("select pg_cancel_backend($1)", pid)
+		case <-done:
+		}
+	}()
+	err = f(tx)
+	close(done)
+	watcher.Wait()
+
+	if err != nil {
+		tx.Rollback()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if strings.Index(err.Error(), "canceling statement due to statement timeout") > -1 {
+			return context.DeadlineExceeded
+		}
+		return err
+	}
+	err = tx.Commit()
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// limit sets the statement timeout of a transaction to whatever is left before the
+// deadline of ctx, so that even if we can't get through to cancel a query, it stops
+// on its own.
+func limit(ctx context.Context, tx *gorp.Transaction) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	ms := time.Until(deadline).Milliseconds()
+	if ms < 1 {
+		return context.DeadlineExceeded
+	}
+	_, err := tx.Exec(fmt.Sprintf("set local statement_timeout = %d", ms))
+	return err
+}
+
+// stored runs f, a call to S3, giving up on it once ctx is done or StorageTimeout has
+// passed.  goamz can't be cancelled, so f carries on in the background; this only keeps
+// the caller from waiting for it, so anything f sets mustn't be used after a failure.
+// The operation names f for the metrics.
+func stored(ctx context.Context, operation string, f func() error) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, StorageTimeout)
+	defer cancel()
+	if err := ready(ctx); err != nil {
+		return err
+	}
+	start := time.Now()
+	defer func() {
+		storageDuration.Observe(metrics.Since(start), operation)
+		if err != nil {
+			storageErrors.Inc(operation)
+		}
+	}()
+	result := make(chan error, 1)
+	go func() {
+		result <- f()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
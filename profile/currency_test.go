@@ -0,0 +1,53 @@
+package profile
+
+import "testing"
+
+func TestGetCurrency(t *testing.T) {
+	tests := []struct {
+		code  string
+		want  string
+		minor int
+		ok    bool
+	}{
+		{"USD", "USD", 2, true},
+		{" jpy ", "JPY", 0, true},
+		{"kwd", "KWD", 3, true},
+		{"XYZ", "", 0, false},
+		{"", "", 0, false},
+	}
+	for _, tt := range tests {
+		c, ok := GetCurrency(tt.code)
+		if ok != tt.ok || c.Code != tt.want || c.Minor != tt.minor {
+			t.Errorf("GetCurrency(%q) = %q, %d, %v; want %q, %d, %v", tt.code, c.Code, c.Minor, ok, tt.want, tt.minor, tt.ok)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	x := ExchangeRates{"USD": 1, "EUR": 0.9, "JPY": 150, "KWD": 0.3, "CHF": 0}
+	tests := []struct {
+		amount   int
+		from, to string
+		want     int
+		ok       bool
+	}{
+		{5000, "USD", "USD", 5000, true},
+		{5000, "USD", "EUR", 4500, true},
+		{5000, "usd", "eur", 4500, true},
+		{5000, "USD", "JPY", 7500, true}, // no minor units
+		{7500, "JPY", "USD", 5000, true}, // and back
+		{1000, "USD", "KWD", 3000, true}, // three digits of minor units
+		{1, "USD", "EUR", 1, true},       // 0.9 of a cent rounds up
+		{4500, "EUR", "JPY", 7500, true}, // neither is the default
+		{5000, "USD", "GBP", 0, false},   // a currency, but no rate for it
+		{5000, "USD", "CHF", 0, false},   // a rate that can't be right
+		{5000, "XYZ", "USD", 0, false},   // not a currency
+		{5000, "USD", "", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := x.Convert(tt.amount, tt.from, tt.to)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Convert(%d, %q, %q) = %d, %v; want %d, %v", tt.amount, tt.from, tt.to, got, ok, tt.want, tt.ok)
+		}
+	}
+}
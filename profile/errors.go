@@ -0,0 +1,32 @@
+package profile
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// Errors this package returns for callers to tell apart, with errors.Is; anything else
+// is a failure of the database or S3.
+var (
+	ErrNotFound         = errors.New("Item Not Found")
+	ErrUnreadableImage  = errors.New("Unreadable Image")
+	ErrPhotoTooLarge    = errors.New("Photo Too Large")
+	ErrPhotoQuota       = errors.New("Photo Quota Exceeded")
+	ErrIncompleteOrder  = errors.New("Order Must List Every Item Once")
+	ErrUnknownRole      = errors.New("Unknown Role")
+	ErrUnknownAction    = errors.New("Unknown Moderation Action")
+	ErrSuspended        = errors.New("Profile Suspended")
+	ErrReviewNotAllowed = errors.New("Review Not Allowed")
+	ErrInviteNotOver    = errors.New("Invite Not Over")
+	ErrDuplicateReview  = errors.New("Duplicate Review Found")
+	ErrBadLogin         = errors.New("Bad Login")
+	ErrNotPermitted     = errors.New("Moderation Not Permitted")
+)
+
+// found turns the error gorp's SelectOne gives for a missing row into ErrNotFound.
+func found(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
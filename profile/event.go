@@ -0,0 +1,167 @@
+package profile
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+// EventKind is the sort of thing an Event records.
+type EventKind string
+
+const (
+	EventLogin             EventKind = "login"
+	EventLoginFailed       EventKind = "login failed"
+	EventLockedOut         EventKind = "locked out"
+	EventLogout            EventKind = "logout"
+	EventAuthCreated       EventKind = "auth created"
+	EventAuthChanged       EventKind = "auth changed"
+	EventAuthConnected     EventKind = "auth connected"
+	EventProfileCreated    EventKind = "profile created"
+	EventProfileChanged    EventKind = "profile changed"
+	EventRolesChanged      EventKind = "roles changed"
+	EventDeletionRequested EventKind = "deletion requested"
+	EventDeletionCancelled EventKind = "deletion cancelled"
+	EventExported          EventKind = "exported"
+	EventInviteCreated     EventKind = "invite created"
+	EventInviteCancelled   EventKind = "invite cancelled"
+	EventInviteAnswered    EventKind = "invite answered"
+	EventAttendeesAdded    EventKind = "attendees added"
+	EventPhotoAdded        EventKind = "photo added"
+	EventPhotoRemoved      EventKind = "photo removed"
+)
+
+var EventKinds map[EventKind]bool = map[EventKind]bool{
+	EventLogin:             true,
+	EventLoginFailed:       true,
+	EventLockedOut:         true,
+	EventLogout:            true,
+	EventAuthCreated:       true,
+	EventAuthChanged:       true,
+	EventAuthConnected:     true,
+	EventProfileCreated:    true,
+	EventProfileChanged:    true,
+	EventRolesChanged:      true,
+	EventDeletionRequested: true,
+	EventDeletionCancelled: true,
+	EventExported:          true,
+	EventInviteCreated:     true,
+	EventInviteCancelled:   true,
+	EventInviteAnswered:    true,
+	EventAttendeesAdded:    true,
+	EventPhotoAdded:        true,
+	EventPhotoRemoved:      true}
+
+// Event is an entry in the log: something that happened to or was done by a Profile,
+// which may be missing when we don't know who it was (as with a failed login for a
+// username that doesn't exist).
+type Event struct {
+	Id       int
+	Profile  *int
+	Happened time.Time
+	Kind     EventKind
+	Details  Details `db:"event"`
+}
+
+// Details are whatever else is worth knowing about an Event, stored as a JSON object.
+// They should never include secrets such as hashes or tokens.
+type Details map[string]interface{}
+
+// EventFilter narrows GetEvents; anything missing or empty doesn't narrow it.
+type EventFilter struct {
+	Profile *int
+	Kinds   []EventKind
+	From    *time.Time
+	To      *time.Time
+	Limit   int
+}
+
+// Scan exists only to convert from the SQL result of a JSON object to Details.
+func (d *Details) Scan(src interface{}) error {
+	var obj []byte
+	switch src := src.(type) {
+	default:
+		return errors.New(fmt.Sprintf("unexpected type %T", src))
+	case nil:
+		*d = Details{}
+		return nil
+	case string:
+		obj = []byte(src)
+	case []uint8:
+		obj = src
+	}
+	*d = Details{}
+	return json.Unmarshal(obj, d)
+}
+
+// Value converts Details back to the JSON object we store.
+func (d Details) Value() (driver.Value, error) {
+	if d == nil {
+		d = Details{}
+	}
+	obj, err := json.Marshal(d)
+	return string(obj), err
+}
+
+// EventKindStrings returns an array of strings of the EventKinds.
+func EventKindStrings() []string {
+	out := []string{}
+	for k := range EventKinds {
+		out = append(out, string(k))
+	}
+	return out
+}
+
+// Record adds an Event to the log.  A failure to record is logged rather than returned,
+// since whatever happened has already happened.
+func Record(profile *int, kind EventKind, details Details) {
+	e := Event{0, profile, time.Now(), kind, details}
+	err := dbmap.Insert(&e)
+	if err != nil {
+		slog.Error("couldn't record event", "kind", kind, "error", err)
+	}
+}
+
+// GetEvents returns the Events matching f, newest first.
+func GetEvents(ctx context.Context, f EventFilter) ([]Event, error) {
+	var params []interface{}
+	es := []Event{}
+	query := "select * from log where true"
+	if f.Profile != nil {
+		params = append(params, *f.Profile)
+		query += " and profile = " + bindVarFor(params)
+	}
+	if len(f.Kinds) > 0 {
+		var ors []string
+		for _, k := range f.Kinds {
+			params = append(params, string(k))
+			ors = append(ors, "kind = "+bindVarFor(params))
+		}
+		query += " and (" + strings.Join(ors, " or ") + ")"
+	}
+	if f.From != nil {
+		params = append(params, *f.From)
+		query += " and happened >= " + bindVarFor(params)
+	}
+	if f.To != nil {
+		params = append(params, *f.To)
+		query += " and happened < " + bindVarFor(params)
+	}
+	query += " order by happened desc, id desc"
+	if f.Limit > 0 {
+		params = append(params, f.Limit)
+		query += " limit " + bindVarFor(params)
+	}
+	err := cancellable(ctx, QueryTimeout, func(s gorp.SqlExecutor) error {
+		_, err := s.Select(&es, query, params...)
+		return err
+	})
+	return es, err
+}
@@ -0,0 +1,26 @@
+package profile
+
+import (
+	"context"
+)
+
+// Ping checks that the database is reachable.
+func Ping(ctx context.Context) error {
+	if err := ready(ctx); err != nil {
+		return err
+	}
+	return dbmap.Db.PingContext(ctx)
+}
+
+// PingStorage checks that S3 is reachable and the photo bucket is there.
+func PingStorage(ctx context.Context) error {
+	return stored(ctx, "list", func() error {
+		_, err := s3Photos.Bucket(BaseBucket).List("", "", "", 1)
+		return err
+	})
+}
+
+// Close closes the database pool.  Nothing in this package may be used afterwards.
+func Close() error {
+	return dbmap.Db.Close()
+}
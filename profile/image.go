@@ -0,0 +1,257 @@
+package profile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// Rendition names one of the sizes we store for every processed Photo.
+type Rendition string
+
+const (
+	RenditionThumbnail Rendition = "thumbnail"
+	RenditionMedium    Rendition = "medium"
+	RenditionFull      Rendition = "full"
+)
+
+const jpegQuality = 85
+
+var (
+	// Renditions lists every Rendition, smallest first.
+	Renditions []Rendition = []Rendition{RenditionThumbnail, RenditionMedium, RenditionFull}
+	// RenditionSizes is the longest edge, in pixels, of each Rendition.  Images are never
+	// scaled up, so a small upload may produce several identical renditions.
+	RenditionSizes map[Rendition]int = map[Rendition]int{
+		RenditionThumbnail: 200,
+		RenditionMedium:    800,
+		RenditionFull:      2048}
+)
+
+// processedImage is the result of running an upload through processImage: the encoded
+// bytes of each Rendition, and the content-type they were all encoded as.
+type processedImage struct {
+	ctype      string
+	renditions map[Rendition][]byte
+}
+
+// size is the number of bytes needed to store every Rendition.
+func (i *processedImage) size() int64 {
+	var n int64
+	for _, data := range i.renditions {
+		n += int64(len(data))
+	}
+	return n
+}
+
+// processImage decodes a JPEG, PNG or GIF and re-encodes it at each of the Renditions.
+// Re-encoding is what strips EXIF (and so GPS) data, since none of the encoders we use
+// write any metadata at all; we do honor the EXIF orientation first, though, since
+// otherwise most phone photos would come out sideways.
+//
+// PNGs and GIFs become PNGs, so that transparency survives; everything else is a JPEG.
+func processImage(r io.Reader) (*processedImage, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// check the dimensions from the header before decoding, since a small file can
+	// claim enough pixels to exhaust our memory
+	config, _, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, ErrUnreadableImage
+	}
+	if config.Width > MaxPhotoEdge || config.Height > MaxPhotoEdge || config.Width*config.Height > MaxPhotoPixels {
+		return nil, ErrPhotoTooLarge
+	}
+	src, format, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, ErrUnreadableImage
+	}
+	if format == "jpeg" {
+		src = orient(src, exifOrientation(raw))
+	}
+
+	out := &processedImage{renditions: map[Rendition][]byte{}}
+	encode := func(w io.Writer, m image.Image) error {
+		return jpeg.Encode(w, m, &jpeg.Options{Quality: jpegQuality})
+	}
+	out.ctype = "image/jpeg"
+	if format == "png" || format == "gif" {
+		encode = png.Encode
+		out.ctype = "image/png"
+	}
+
+	flat := toNRGBA(src)
+	for _, rendition := range Renditions {
+		var buf bytes.Buffer
+		err = encode(&buf, resize(flat, RenditionSizes[rendition]))
+		if err != nil {
+			return nil, err
+		}
+		out.renditions[rendition] = buf.Bytes()
+	}
+	return out, nil
+}
+
+// toNRGBA copies m into an NRGBA with its origin at zero, the form resize works on.  An
+// image which is already in that form is returned as it is.
+func toNRGBA(m image.Image) *image.NRGBA {
+	b := m.Bounds()
+	if n, ok := m.(*image.NRGBA); ok && b.Min == (image.Point{}) {
+		return n
+	}
+	n := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(n, n.Bounds(), m, b.Min, draw.Src)
+	return n
+}
+
+// resize scales src down so that its longest edge is no more than max pixels, averaging
+// every source pixel that falls in each destination pixel.  Images which already fit
+// are returned unchanged, so the result may be src itself.
+func resize(src *image.NRGBA, max int) image.Image {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w <= max && h <= max {
+		return src
+	}
+
+	dw, dh := max, max
+	if w > h {
+		dh = h * max / w
+	} else {
+		dw = w * max / h
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, (y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, (x+1)*w/dw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint64(p[0])
+					g += uint64(p[1])
+					bl += uint64(p[2])
+					a += uint64(p[3])
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{uint8(r / n), uint8(g / n), uint8(bl / n), uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+// orient applies an EXIF orientation (1 through 8) to m.  Anything else is left alone.
+func orient(m image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return m
+	}
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// orientations 5 through 8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // upside down and mirrored
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90 counterclockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, m.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// exifOrientation digs the orientation tag out of the EXIF block of a JPEG, returning
+// 0 if there isn't one or if the data doesn't look the way we expect.
+func exifOrientation(raw []byte) int {
+	r := bytes.NewReader(raw)
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil || marker != [2]byte{0xff, 0xd8} {
+		return 0
+	}
+	for {
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xff {
+			return 0
+		}
+		var size uint16
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil || size < 2 {
+			return 0
+		}
+		segment := make([]byte, size-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return 0
+		}
+		// APP1 holds EXIF; start of scan means there's no metadata left to find
+		if marker[1] == 0xda {
+			return 0
+		}
+		if marker[1] == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+	}
+}
+
+// tiffOrientation supports exifOrientation by walking IFD0 of a TIFF header.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
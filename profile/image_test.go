@@ -0,0 +1,52 @@
+package profile
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestOrient(t *testing.T) {
+	// a 3 by 2 image with every pixel different, so we can see where each one went
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{uint8(10 * x), uint8(10 * y), 0, 255})
+		}
+	}
+	topLeft, topRight := src.At(0, 0), src.At(2, 0)
+
+	tests := []struct {
+		orientation int
+		w, h        int
+		topLeft     image.Point // where the source's top left pixel should end up
+		topRight    image.Point // and its top right
+	}{
+		{2, 3, 2, image.Pt(2, 0), image.Pt(0, 0)},
+		{3, 3, 2, image.Pt(2, 1), image.Pt(0, 1)},
+		{4, 3, 2, image.Pt(0, 1), image.Pt(2, 1)},
+		{5, 2, 3, image.Pt(0, 0), image.Pt(0, 2)},
+		{6, 2, 3, image.Pt(1, 0), image.Pt(1, 2)},
+		{7, 2, 3, image.Pt(1, 2), image.Pt(1, 0)},
+		{8, 2, 3, image.Pt(0, 2), image.Pt(0, 0)},
+	}
+	for _, tt := range tests {
+		m := orient(src, tt.orientation)
+		if b := m.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("orientation %d: got %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), tt.w, tt.h)
+			continue
+		}
+		if got := m.At(tt.topLeft.X, tt.topLeft.Y); got != topLeft {
+			t.Errorf("orientation %d: top left pixel isn't at %v; found %v", tt.orientation, tt.topLeft, got)
+		}
+		if got := m.At(tt.topRight.X, tt.topRight.Y); got != topRight {
+			t.Errorf("orientation %d: top right pixel isn't at %v; found %v", tt.orientation, tt.topRight, got)
+		}
+	}
+
+	for _, orientation := range []int{0, 1, 9, -1} {
+		if m := orient(src, orientation); m != image.Image(src) {
+			t.Errorf("orientation %d: image was changed", orientation)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package profile
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// earthRadiusMiles is the mean radius of the Earth, in statute miles, as used by the
+// earthdistance <@> operator.
+const earthRadiusMiles = 3958.761
+
+// FreetimeMiles is how far from a Freetime's Location a shoot can be and still be near
+// it, both for Search and for warning about Invites.
+var FreetimeMiles float64 = 50
+
+// Address is the parts of a street address, any of which may be empty.
+type Address struct {
+	Street     string
+	City       string
+	Region     string
+	PostalCode string
+	Country    string
+}
+
+// Valid reports whether the Location is a possible latitude and longitude.
+func (l Location) Valid() bool {
+	return l.Latitude >= -90 && l.Latitude <= 90 && l.Longitude >= -180 && l.Longitude <= 180
+}
+
+// MilesTo returns the great circle distance between two Locations, in statute miles.
+func (l Location) MilesTo(o Location) float64 {
+	rad := func(deg float32) float64 { return float64(deg) * math.Pi / 180 }
+	dLat := rad(o.Latitude - l.Latitude)
+	dLon := rad(o.Longitude - l.Longitude)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(l.Latitude))*math.Cos(rad(o.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMiles * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// Covers reports whether the Freetime includes the time t.
+func (f *Freetime) Covers(t time.Time) bool {
+	return !t.Before(f.Start) && !t.After(f.End)
+}
+
+// Scan exists only to convert from the SQL result of a JSON object to an Address.
+func (a *Address) Scan(src interface{}) error {
+	switch src := src.(type) {
+	default:
+		return errors.New(fmt.Sprintf("unexpected type %T", src))
+	case string:
+		return json.Unmarshal([]byte(src), a)
+	case []uint8:
+		return json.Unmarshal(src, a)
+	}
+}
+
+// Value converts an Address back to the JSON object we store.
+func (a Address) Value() (driver.Value, error) {
+	out, err := json.Marshal(a)
+	return string(out), err
+}
+
+// GetLocatedFreetimes returns the Freetimes with a Location of each of ids which include
+// any time from 'from' to 'to', by Profile.  Their Utypes and Flags aren't loaded.
+func GetLocatedFreetimes(ctx context.Context, ids []int, from, to time.Time) (map[int][]Freetime, error) {
+	out := map[int][]Freetime{}
+	ids = uniqueIds(ids)
+	if len(ids) == 0 {
+		return out, nil
+	}
+	if err := ready(ctx); err != nil {
+		return out, err
+	}
+	list, params := inList([]interface{}{from, to}, ids)
+	fs := []Freetime{}
+	q := "select * from free where location is not null and freeend >= $1 and freestart <= $2 and profile in " + list + " order by freestart asc"
+	_, err := dbmap.Select(&fs, q, params...)
+	if err != nil {
+		return out, err
+	}
+	for _, f := range fs {
+		out[f.Profile] = append(out[f.Profile], f)
+	}
+	return out, nil
+}
@@ -0,0 +1,35 @@
+package profile
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMilesTo(t *testing.T) {
+	newYork := Location{40.7128, -74.0060}
+	losAngeles := Location{34.0522, -118.2437}
+	london := Location{51.5074, -0.1278}
+	paris := Location{48.8566, 2.3522}
+	tests := []struct {
+		name string
+		a, b Location
+		want float64
+	}{
+		{"same place", newYork, newYork, 0},
+		{"a degree of latitude", Location{0, 0}, Location{1, 0}, 69.09},
+		{"across the dateline", Location{0, 179.5}, Location{0, -179.5}, 69.09},
+		{"New York to Los Angeles", newYork, losAngeles, 2445},
+		{"London to Paris", london, paris, 213.5},
+		{"halfway around", Location{0, 0}, Location{0, 180}, 12436.6},
+		{"pole to pole", Location{90, 0}, Location{-90, 0}, 12436.6},
+	}
+	for _, tt := range tests {
+		got := tt.a.MilesTo(tt.b)
+		if math.Abs(got-tt.want) > math.Max(0.01, tt.want*0.005) {
+			t.Errorf("%s: got %.2f miles, want about %.2f", tt.name, got, tt.want)
+		}
+		if back := tt.b.MilesTo(tt.a); math.Abs(back-got) > 0.01 {
+			t.Errorf("%s: %.2f miles there but %.2f back", tt.name, got, back)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package profile
+
+import (
+	"log/slog"
+)
+
+// This package logs through the slog default logger, which the server sets up with its
+// levels and redaction.
+
+// TraceSQL turns logging of every statement gorp runs on or off.  The statements are
+// logged at debug level without their arguments, which include hashes and tokens.
+func TraceSQL(on bool) {
+	if on {
+		dbmap.TraceOn("", sqlLogger{})
+	} else {
+		dbmap.TraceOff()
+	}
+}
+
+// sqlLogger is the gorp.GorpLogger for TraceSQL.  gorp calls it with the prefix, the
+// statement and the arguments, in that order.
+type sqlLogger struct{}
+
+func (sqlLogger) Printf(format string, v ...interface{}) {
+	if len(v) < 2 {
+		return
+	}
+	args := 0
+	if a, ok := v[len(v)-1].([]interface{}); ok {
+		args = len(a)
+	}
+	slog.Debug("sql", "statement", v[1], "args", args)
+}
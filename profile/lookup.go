@@ -0,0 +1,142 @@
+package profile
+
+import (
+	"context"
+)
+
+// Flags, Utypes and RateTypes are never deleted, since Profiles and Freetimes refer to
+// them; instead they're Retired, which hides them from the lists clients choose from.
+
+// AllFlags returns every Flag, including those Retired.
+func AllFlags(ctx context.Context) ([]Flag, error) {
+	l, err := cachedLookups(ctx)
+	return append([]Flag{}, l.flags...), err
+}
+
+// AllTypes returns every Utype, including those Retired.
+func AllTypes(ctx context.Context) ([]Utype, error) {
+	l, err := cachedLookups(ctx)
+	return append([]Utype{}, l.utypes...), err
+}
+
+// AllRateTypes returns every RateType, including those Retired.
+func AllRateTypes(ctx context.Context) ([]RateType, error) {
+	l, err := cachedLookups(ctx)
+	return append([]RateType{}, l.rateTypes...), err
+}
+
+// Create saves a new Flag.
+func (f *Flag) Create(ctx context.Context) error {
+	if err := ready(ctx); err != nil {
+		return err
+	}
+	defer InvalidateLookups()
+	return dbmap.Insert(f)
+}
+
+// Save saves a Flag, which may be renamed or Retired.
+func (f *Flag) Save(ctx context.Context) error {
+	if err := ready(ctx); err != nil {
+		return err
+	}
+	defer InvalidateLookups()
+	return saveOne(dbmap.Update(f))
+}
+
+// Create saves a new Utype.
+func (t *Utype) Create(ctx context.Context) error {
+	if err := ready(ctx); err != nil {
+		return err
+	}
+	defer InvalidateLookups()
+	return dbmap.Insert(t)
+}
+
+// Save saves a Utype, which may be renamed or Retired.
+func (t *Utype) Save(ctx context.Context) error {
+	if err := ready(ctx); err != nil {
+		return err
+	}
+	defer InvalidateLookups()
+	return saveOne(dbmap.Update(t))
+}
+
+// Create saves a new RateType at the end of the Sort order.  RateType ids aren't
+// serial, so we pick the next one ourselves.
+func (r *RateType) Create(ctx context.Context) error {
+	if err := ready(ctx); err != nil {
+		return err
+	}
+	defer InvalidateLookups()
+	id, err := dbmap.SelectInt("select coalesce(max(id), 0) + 1 from ratetype")
+	if err != nil {
+		return err
+	}
+	sort, err := dbmap.SelectInt("select coalesce(max(sort), 0) + 1 from ratetype")
+	if err != nil {
+		return err
+	}
+	r.Id = int(id)
+	r.Sort = int(sort)
+	return dbmap.Insert(r)
+}
+
+// Save saves a RateType, which may be renamed or Retired.  Use ReorderRateTypes to
+// change Sort.
+func (r *RateType) Save(ctx context.Context) error {
+	if err := ready(ctx); err != nil {
+		return err
+	}
+	defer InvalidateLookups()
+	return saveOne(dbmap.Update(r))
+}
+
+// ReorderRateTypes sets Sort on every RateType to match the order of ids, which must
+// list each RateType exactly once.
+func ReorderRateTypes(ctx context.Context, ids []int) error {
+	defer InvalidateLookups()
+	all, err := AllRateTypes(ctx)
+	if err != nil {
+		return err
+	}
+	if len(ids) != len(all) {
+		return ErrIncompleteOrder
+	}
+	known := map[int]bool{}
+	for _, r := range all {
+		known[r.Id] = true
+	}
+	for _, id := range ids {
+		if !known[id] {
+			return ErrIncompleteOrder
+		}
+		delete(known, id)
+	}
+
+	return InTransaction(ctx, func(t *Tx) error {
+		s := t.executor()
+		// sort is unique, so move everything out of the way first
+		_, err := s.Exec("update ratetype set sort = -sort - 1")
+		if err != nil {
+			return err
+		}
+		for i, id := range ids {
+			_, err = s.Exec("update ratetype set sort = $1 where id = $2", i+1, id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// saveOne checks the result of a gorp Update of a single row.
+func saveOne(count int64, err error) error {
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package profile
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/randallsquared/gochute/metrics"
+)
+
+var (
+	queryDuration = metrics.NewHistogram("chute_db_query_duration_seconds",
+		"Time taken by database statements, by kind of statement.", metrics.DefBuckets, "statement")
+	queryErrors = metrics.NewCounter("chute_db_query_errors_total",
+		"Database statements which failed, by kind of statement.", "statement")
+	storageDuration = metrics.NewHistogram("chute_storage_duration_seconds",
+		"Time taken by calls to S3, by operation.", metrics.DefBuckets, "operation")
+	storageErrors = metrics.NewCounter("chute_storage_errors_total",
+		"Calls to S3 which failed or were given up on, by operation.", "operation")
+)
+
+func init() {
+	metrics.NewGaugeFunc("chute_db_connections_open", "Database connections open, in use or idle.",
+		func() float64 { return float64(dbmap.Db.Stats().OpenConnections) })
+	metrics.NewGaugeFunc("chute_db_connections_in_use", "Database connections in use.",
+		func() float64 { return float64(dbmap.Db.Stats().InUse) })
+	metrics.NewGaugeFunc("chute_db_connections_idle", "Database connections idle.",
+		func() float64 { return float64(dbmap.Db.Stats().Idle) })
+	metrics.NewCounterFunc("chute_db_connection_waits_total", "Times a database connection had to be waited for.",
+		func() float64 { return float64(dbmap.Db.Stats().WaitCount) })
+	metrics.NewCounterFunc("chute_db_connection_wait_seconds_total", "Time spent waiting for database connections.",
+		func() float64 { return dbmap.Db.Stats().WaitDuration.Seconds() })
+}
+
+// statementKind labels a statement by its first word, so that the metrics don't have a
+// series for every query.
+func statementKind(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "other"
+	}
+	switch kind := strings.ToLower(fields[0]); kind {
+	case "select", "insert", "update", "delete", "set":
+		return kind
+	}
+	return "other"
+}
+
+func observeQuery(query string, start time.Time, err error) {
+	kind := statementKind(query)
+	queryDuration.Observe(metrics.Since(start), kind)
+	if err != nil && err != driver.ErrSkip {
+		queryErrors.Inc(kind)
+	}
+}
+
+// gorp has no hooks, so statements are timed by wrapping the connections it's given.
+// Only the time until the driver returns is counted, not reading the rows.
+
+// timedConnector gives out timedConns.
+type timedConnector struct {
+	driver.Connector
+}
+
+func (c timedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return timedConn{conn}, nil
+}
+
+// timedConn times statements run directly on the connection, and prepares timedStmts.
+// If the driver can't run a statement directly, it says so with driver.ErrSkip, and
+// database/sql prepares it instead.  database/sql only sees the interfaces timedConn
+// has itself, so it has all the optional ones, handing each to the driver's connection
+// when that has it too, and otherwise doing what database/sql would have done without.
+type timedConn struct {
+	driver.Conn
+}
+
+// errNamedArgs is what database/sql would have said about named arguments to a driver
+// which doesn't take them.
+var errNamedArgs = errors.New("sql: driver does not support the use of Named Parameters")
+
+// values strips the names and ordinals from args, for drivers which don't take them.
+func values(args []driver.NamedValue) ([]driver.Value, error) {
+	vs := make([]driver.Value, len(args))
+	for j, arg := range args {
+		if arg.Name != "" {
+			return nil, errNamedArgs
+		}
+		vs[j] = arg.Value
+	}
+	return vs, nil
+}
+
+func (c timedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c timedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c timedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != 0 || opts.ReadOnly {
+		return nil, errors.New("sql: driver does not support non-default transaction options")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Conn.Begin()
+}
+
+func (c timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	preparer, ok := c.Conn.(driver.ConnPrepareContext)
+	if !ok {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return c.Prepare(query)
+	}
+	stmt, err := preparer.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return timedStmt{stmt, query}, nil
+}
+
+func (c timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		vs, err := values(args)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return c.Exec(query, vs)
+	}
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	observeQuery(query, start, err)
+	return result, err
+}
+
+func (c timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		vs, err := values(args)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return c.Query(query, vs)
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	observeQuery(query, start, err)
+	return rows, err
+}
+
+func (c timedConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return timedStmt{stmt, query}, nil
+}
+
+func (c timedConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.Execer)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := execer.Exec(query, args)
+	observeQuery(query, start, err)
+	return result, err
+}
+
+func (c timedConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.Queryer)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := queryer.Query(query, args)
+	observeQuery(query, start, err)
+	return rows, err
+}
+
+type timedStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s timedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	start := time.Now()
+	result, err := s.Stmt.Exec(args)
+	observeQuery(s.query, start, err)
+	return result, err
+}
+
+func (s timedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.Stmt.Query(args)
+	observeQuery(s.query, start, err)
+	return rows, err
+}
+
+func (s timedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := s.Stmt.(driver.StmtExecContext)
+	if !ok {
+		vs, err := values(args)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return s.Exec(vs)
+	}
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, args)
+	observeQuery(s.query, start, err)
+	return result, err
+}
+
+func (s timedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := s.Stmt.(driver.StmtQueryContext)
+	if !ok {
+		vs, err := values(args)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return s.Query(vs)
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, args)
+	observeQuery(s.query, start, err)
+	return rows, err
+}
@@ -0,0 +1,26 @@
+package profile
+
+import "testing"
+
+func TestStatementKind(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"select * from profile where id = $1", "select"},
+		{"SELECT 1", "select"},
+		{"\n\t  insert into free (profile) values ($1)", "insert"},
+		{"update photo set sort = $1", "update"},
+		{"Delete from auth where profile = $1", "delete"},
+		{"set local statement_timeout = 1000", "set"},
+		{"with mine as (select 1) select * from mine", "other"},
+		{"begin", "other"},
+		{"", "other"},
+		{"   ", "other"},
+	}
+	for _, tt := range tests {
+		if got := statementKind(tt.query); got != tt.want {
+			t.Errorf("statementKind(%q) = %q; want %q", tt.query, got, tt.want)
+		}
+	}
+}
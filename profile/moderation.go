@@ -0,0 +1,340 @@
+package profile
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+// ReportKind is the sort of thing a Report is about.
+type ReportKind string
+
+const (
+	KindProfile ReportKind = "profile"
+	KindPhoto   ReportKind = "photo"
+	KindMessage ReportKind = "message"
+)
+
+// Reason is why a Report was made.
+type Reason string
+
+const (
+	ReasonSpam          Reason = "spam"
+	ReasonHarassment    Reason = "harassment"
+	ReasonInappropriate Reason = "inappropriate"
+	ReasonImpersonation Reason = "impersonation"
+	ReasonOther         Reason = "other"
+)
+
+// ReportStatus tracks a Report through the moderation queue.
+type ReportStatus string
+
+const (
+	ReportOpen     ReportStatus = "open"
+	ReportAssigned ReportStatus = "assigned"
+	ReportResolved ReportStatus = "resolved"
+)
+
+// Action is something a moderator can do to a Profile, Photo or Message.
+type Action string
+
+const (
+	ActionHidePhoto      Action = "hide photo"
+	ActionShowPhoto      Action = "show photo"
+	ActionSuspendProfile Action = "suspend profile"
+	ActionRestoreProfile Action = "restore profile"
+	ActionDeleteMessage  Action = "delete message"
+	ActionAssignReport   Action = "assign report"
+	ActionResolveReport  Action = "resolve report"
+)
+
+var (
+	ReportKinds map[ReportKind]bool = map[ReportKind]bool{
+		KindProfile: true,
+		KindPhoto:   true,
+		KindMessage: true}
+	Reasons map[Reason]bool = map[Reason]bool{
+		ReasonSpam:          true,
+		ReasonHarassment:    true,
+		ReasonInappropriate: true,
+		ReasonImpersonation: true,
+		ReasonOther:         true}
+	ReportStatuses map[ReportStatus]bool = map[ReportStatus]bool{
+		ReportOpen:     true,
+		ReportAssigned: true,
+		ReportResolved: true}
+	// Actions maps each Action a moderator may take directly to the kind of thing it's
+	// done to.  Assigning and resolving are done through the Report itself.
+	Actions map[Action]ReportKind = map[Action]ReportKind{
+		ActionHidePhoto:      KindPhoto,
+		ActionShowPhoto:      KindPhoto,
+		ActionSuspendProfile: KindProfile,
+		ActionRestoreProfile: KindProfile,
+		ActionDeleteMessage:  KindMessage}
+)
+
+// Report is a complaint by one Profile about a Profile, Photo or Message.
+type Report struct {
+	Id         int
+	Reporter   int // Profile
+	Kind       ReportKind
+	Subject    int // Profile, Photo or Message, depending on Kind
+	Reason     Reason
+	Details    string
+	Created    time.Time
+	Status     ReportStatus
+	Assignee   *int // Profile
+	Resolved   *time.Time
+	Resolution *string
+}
+
+// Moderation records an Action taken by a moderator, so that every one of them can be
+// reviewed later.  Report is set when the Action was taken while handling one.
+type Moderation struct {
+	Id        int
+	Moderator int // Profile
+	Action    Action
+	Kind      ReportKind
+	Subject   int
+	Report    *int
+	Note      string
+	Happened  time.Time
+}
+
+// ReasonStrings returns an array of strings of the Reasons.
+func ReasonStrings() []string {
+	out := []string{}
+	for k := range Reasons {
+		out = append(out, string(k))
+	}
+	return out
+}
+
+// ActionStrings returns an array of strings of the Actions moderators may take directly.
+func ActionStrings() []string {
+	out := []string{}
+	for k := range Actions {
+		out = append(out, string(k))
+	}
+	return out
+}
+
+// subjectExists checks that there is a Profile, Photo or Message with the given id.
+func subjectExists(s gorp.SqlExecutor, kind ReportKind, id int) error {
+	var table string
+	switch kind {
+	case KindProfile:
+		table = "profile"
+	case KindPhoto:
+		table = "photo"
+	case KindMessage:
+		table = "message"
+	default:
+		return ErrNotFound
+	}
+	count, err := s.SelectInt("select count(*) from "+table+" where id = $1", id)
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// NewReport initializes a new open Report from the receiver.  It does not save.
+func (p *Profile) NewReport(kind ReportKind, subject int, reason Reason, details string) Report {
+	return Report{0, p.Id, kind, subject, reason, details, time.Now(), ReportOpen, nil, nil, nil}
+}
+
+// Create saves a Report, returning ErrNotFound if what it's about doesn't exist.
+func (r *Report) Create(ctx context.Context) error {
+	if err := ready(ctx); err != nil {
+		return err
+	}
+	err := subjectExists(dbmap, r.Kind, r.Subject)
+	if err != nil {
+		return err
+	}
+	return dbmap.Insert(r)
+}
+
+// GetReport returns a pointer to a Report, and an error (ErrNotFound if no such row existed).
+func GetReport(ctx context.Context, id int) (*Report, error) {
+	if err := ready(ctx); err != nil {
+		return nil, err
+	}
+	out, err := dbmap.Get(new(Report), id)
+	if err != nil {
+		return nil, err
+	} else if out == nil {
+		return nil, ErrNotFound
+	}
+	return out.(*Report), err
+}
+
+// GetReports returns the moderation queue: Reports with any of the given statuses (all
+// of them if statuses is empty), oldest first.
+func GetReports(ctx context.Context, statuses []ReportStatus) ([]Report, error) {
+	var params []interface{}
+	rs := []Report{}
+	query := "select * from report"
+	if len(statuses) > 0 {
+		var ors []string
+		for _, s := range statuses {
+			params = append(params, string(s))
+			ors = append(ors, "status = "+bindVarFor(params))
+		}
+		query += " where " + strings.Join(ors, " or ")
+	}
+	query += " order by created asc"
+	err := cancellable(ctx, QueryTimeout, func(s gorp.SqlExecutor) error {
+		_, err := s.Select(&rs, query, params...)
+		return err
+	})
+	return rs, err
+}
+
+// Assign gives the Report to a moderator to handle.
+func (r *Report) Assign(ctx context.Context, moderator, assignee int) error {
+	return InTransaction(ctx, func(t *Tx) error {
+		r.Assignee = &assignee
+		r.Status = ReportAssigned
+		_, err := t.executor().Update(r)
+		if err != nil {
+			return err
+		}
+		return audit(t.executor(), moderator, ActionAssignReport, r.Kind, r.Subject, &r.Id, "")
+	})
+}
+
+// Resolve closes the Report, noting what was done about it.
+func (r *Report) Resolve(ctx context.Context, moderator int, resolution string) error {
+	return InTransaction(ctx, func(t *Tx) error {
+		now := time.Now()
+		r.Status = ReportResolved
+		r.Resolved = &now
+		r.Resolution = &resolution
+		if r.Assignee == nil {
+			r.Assignee = &moderator
+		}
+		_, err := t.executor().Update(r)
+		if err != nil {
+			return err
+		}
+		return audit(t.executor(), moderator, ActionResolveReport, r.Kind, r.Subject, &r.Id, resolution)
+	})
+}
+
+// audit records a Moderation of a Report.
+func audit(s gorp.SqlExecutor, moderator int, a Action, kind ReportKind, subject int, report *int, note string) error {
+	m := Moderation{0, moderator, a, kind, subject, report, note, time.Now()}
+	return s.Insert(&m)
+}
+
+// Moderate takes an Action on the subject and records that it was done, all or nothing.
+// The subject must be the kind of thing the Action is done to, or we return ErrNotFound.
+// Nobody may suspend themselves, and only admins may suspend admins; otherwise we
+// return ErrNotPermitted.
+func Moderate(ctx context.Context, moderator int, a Action, subject int, report *int, note string) (*Moderation, error) {
+	kind, ok := Actions[a]
+	if !ok {
+		return nil, ErrUnknownAction
+	}
+	m := &Moderation{0, moderator, a, kind, subject, report, note, time.Now()}
+	err := InTransaction(ctx, func(t *Tx) error {
+		s := t.executor()
+		err := subjectExists(s, kind, subject)
+		if err == nil && a == ActionSuspendProfile {
+			err = maySuspend(s, moderator, subject)
+		}
+		if err == nil {
+			err = moderate(s, a, subject)
+		}
+		if err != nil {
+			return err
+		}
+		return s.Insert(m)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if kind == KindProfile {
+		// a suspended Profile's tokens must stop working right away
+		forgetProfile(subject)
+	}
+	return m, nil
+}
+
+// maySuspend supports Moderate by checking that moderator may suspend subject.
+func maySuspend(s gorp.SqlExecutor, moderator, subject int) error {
+	if moderator == subject {
+		return ErrNotPermitted
+	}
+	var mine, theirs Roles
+	for _, r := range []struct {
+		id    int
+		roles *Roles
+	}{{moderator, &mine}, {subject, &theirs}} {
+		list, err := s.SelectStr("select roles from profile where id = $1", r.id)
+		if err != nil {
+			return err
+		}
+		r.roles.Scan(list)
+	}
+	if theirs.Has(RoleAdmin) && !mine.Has(RoleAdmin) {
+		return ErrNotPermitted
+	}
+	return nil
+}
+
+// moderate supports Moderate by doing the actual work of each Action.
+func moderate(s gorp.SqlExecutor, a Action, subject int) error {
+	var err error
+	switch a {
+	case ActionHidePhoto:
+		_, err = s.Exec("update photo set hidden = true, isprimary = false where id = $1", subject)
+		if err == nil {
+			// someone else gets to be the avatar, if there's anyone left
+			q := `update photo set isprimary = true where id = (
+			  select id from photo where profile = (select profile from photo where id = $1)
+			  and not hidden order by sort asc, id asc limit 1)
+			  and not exists (select 1 from photo where profile = (select profile from photo where id = $1)
+			  and isprimary)`
+			_, err = s.Exec(q, subject)
+		}
+	case ActionShowPhoto:
+		_, err = s.Exec("update photo set hidden = false where id = $1", subject)
+	case ActionSuspendProfile:
+		_, err = s.Exec("update profile set suspended = true, updated = now() where id = $1", subject)
+	case ActionRestoreProfile:
+		_, err = s.Exec("update profile set suspended = false, updated = now() where id = $1", subject)
+	case ActionDeleteMessage:
+		_, err = s.Exec("delete from message where id = $1", subject)
+	}
+	return err
+}
+
+// GetModerations returns the audit trail of moderator Actions, newest first, optionally
+// only those about a particular subject.
+func GetModerations(ctx context.Context, kind *ReportKind, subject *int) ([]Moderation, error) {
+	var params []interface{}
+	ms := []Moderation{}
+	query := "select * from moderation where true"
+	if kind != nil {
+		params = append(params, string(*kind))
+		query += " and kind = " + bindVarFor(params)
+	}
+	if subject != nil {
+		params = append(params, *subject)
+		query += " and subject = " + bindVarFor(params)
+	}
+	query += " order by happened desc"
+	err := cancellable(ctx, QueryTimeout, func(s gorp.SqlExecutor) error {
+		_, err := s.Select(&ms, query, params...)
+		return err
+	})
+	return ms, err
+}
@@ -0,0 +1,81 @@
+package profile
+
+import (
+	"context"
+)
+
+// Visibility is who may see one of a Profile's contact details.
+type Visibility string
+
+const (
+	VisibilityPublic  Visibility = "public"  // anyone logged in
+	VisibilityShared  Visibility = "shared"  // people who share an Invite with the Profile
+	VisibilityPrivate Visibility = "private" // only the Profile itself
+)
+
+// DefaultVisibility is what new Profiles start with for each contact detail.
+const DefaultVisibility = VisibilityShared
+
+var Visibilities map[Visibility]bool = map[Visibility]bool{
+	VisibilityPublic:  true,
+	VisibilityShared:  true,
+	VisibilityPrivate: true}
+
+// VisibilityStrings returns an array of strings of the Visibilities.
+func VisibilityStrings() []string {
+	out := []string{}
+	for k := range Visibilities {
+		out = append(out, string(k))
+	}
+	return out
+}
+
+// Allows reports whether a viewer may see a detail with this Visibility, given whether
+// the viewer is the Profile itself, and whether the two share an Invite.  Anything we
+// don't recognize is treated as private.
+func (v Visibility) Allows(self, shared bool) bool {
+	switch v {
+	case VisibilityPublic:
+		return true
+	case VisibilityShared:
+		return self || shared
+	}
+	return self
+}
+
+// contactConnector is a connector for getting which Profiles share an Invite with another.
+type contactConnector struct {
+	Connector int
+}
+
+// Contacts returns which of ids share an Invite with the receiver, meaning that each is
+// the organizer or an accepted Attendee of it.  Merely being invited isn't enough, or
+// anyone could see contact details by sending an Invite.
+func (p *Profile) Contacts(ctx context.Context, ids []int) (map[int]bool, error) {
+	out := map[int]bool{}
+	ids = uniqueIds(ids)
+	if len(ids) == 0 {
+		return out, nil
+	}
+	if err := ready(ctx); err != nil {
+		return out, err
+	}
+	list, params := inList([]interface{}{p.Id, string(StatusAccepted)}, ids)
+	q := `
+with mine as (
+  select id as invite from invite where organizer = $1 and active
+  union select invite from profile_invite inner join invite on (invite = id)
+  where profile = $1 and status = $2 and active
+)
+select organizer as connector from invite where id in (select invite from mine) and organizer in ` + list + `
+union select profile as connector from profile_invite where invite in (select invite from mine) and status = $2 and profile in ` + list
+	found := []contactConnector{}
+	_, err := dbmap.Select(&found, q, params...)
+	if err != nil {
+		return out, err
+	}
+	for _, c := range found {
+		out[c.Connector] = true
+	}
+	return out, nil
+}
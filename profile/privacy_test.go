@@ -0,0 +1,29 @@
+package profile
+
+import "testing"
+
+func TestVisibilityAllows(t *testing.T) {
+	tests := []struct {
+		v            Visibility
+		self, shared bool
+		want         bool
+	}{
+		{VisibilityPublic, false, false, true},
+		{VisibilityPublic, false, true, true},
+		{VisibilityPublic, true, false, true},
+		{VisibilityShared, false, false, false},
+		{VisibilityShared, false, true, true},
+		{VisibilityShared, true, false, true},
+		{VisibilityPrivate, false, false, false},
+		{VisibilityPrivate, false, true, false},
+		{VisibilityPrivate, true, false, true},
+		{"", false, true, false}, // anything unknown is private
+		{"everyone", false, false, false},
+		{"everyone", true, false, true},
+	}
+	for _, tt := range tests {
+		if got := tt.v.Allows(tt.self, tt.shared); got != tt.want {
+			t.Errorf("%q.Allows(self %v, shared %v) = %v; want %v", tt.v, tt.self, tt.shared, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package profile
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"launchpad.net/goamz/s3"
+)
+
+// ReconcileGrace is how old an S3 object with no photo row must be before Reconcile
+// calls it an orphan, and how old a photo row with no object must be before it's called
+// missing, so that we don't delete uploads which are still in progress.
+var ReconcileGrace = time.Hour
+
+// ReconcileReport lists what Reconcile found.  OrphanObjects are keys, relative to
+// BaseBucket, which no photo row refers to; MissingObjects are Photos whose full size
+// file is not in S3.  Fixed is true if Reconcile deleted both.
+type ReconcileReport struct {
+	Objects        int
+	Photos         int
+	OrphanObjects  []string
+	MissingObjects []Photo
+	Fixed          bool
+}
+
+type folderPhoto struct {
+	Folder string
+	Photo
+}
+
+// Reconcile compares every object in BaseBucket with every row in photo.  If fix is
+// true, orphaned objects are deleted from S3 and Photos with missing files are removed
+// (which also clears them from any Messages); otherwise this only reports.
+func Reconcile(ctx context.Context, fix bool) (*ReconcileReport, error) {
+	report := &ReconcileReport{Fixed: fix}
+	root := s3Photos.Bucket(BaseBucket)
+
+	// the rows come first: a Photo's files are all stored before its row is inserted, so
+	// every row we see had its files in place before the listing started, and files
+	// stored after this are covered by ReconcileGrace
+	photos := []folderPhoto{}
+	q := "select profile.folder, photo.* from photo inner join profile on (photo.profile = profile.id)"
+	_, err := dbmap.Select(&photos, q)
+	if err != nil {
+		return nil, err
+	}
+	report.Photos = len(photos)
+
+	objects := map[string]time.Time{}
+	marker := ""
+	for {
+		var list *s3.ListResp
+		err = stored(ctx, "list", func() error {
+			var err error
+			list, err = root.List("", "", marker, 1000)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range list.Contents {
+			modified, err := time.Parse(time.RFC3339Nano, key.LastModified)
+			if err != nil {
+				// if we can't tell how old it is, assume it's brand new
+				modified = time.Now()
+			}
+			objects[key.Key] = modified
+			marker = key.Key
+		}
+		if !list.IsTruncated || len(list.Contents) == 0 {
+			break
+		}
+	}
+	report.Objects = len(objects)
+
+	cutoff := time.Now().Add(-ReconcileGrace)
+	expected := map[string]bool{}
+	for _, fp := range photos {
+		for _, key := range fp.keys() {
+			expected[fp.Folder+"/"+key] = true
+		}
+		if _, ok := objects[fp.Folder+"/"+fp.Href]; !ok && fp.Created.Before(cutoff) {
+			report.MissingObjects = append(report.MissingObjects, fp.Photo)
+			if fix {
+				err = fp.Remove(ctx, fp.Folder)
+				if err != nil {
+					return report, err
+				}
+			}
+		}
+	}
+
+	for key, modified := range objects {
+		if expected[key] || modified.After(cutoff) {
+			continue
+		}
+		report.OrphanObjects = append(report.OrphanObjects, key)
+		if fix {
+			err = stored(ctx, "delete", func() error { return root.Del(key) })
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+	slog.Info("reconciled", "objects", report.Objects, "photos", report.Photos,
+		"orphaned", len(report.OrphanObjects), "missing", len(report.MissingObjects))
+	return report, nil
+}
@@ -0,0 +1,123 @@
+package profile
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Ratings run from MinRating to MaxRating stars.
+const (
+	MinRating = 1
+	MaxRating = 5
+)
+
+// Review is one participant's rating of another after an Invite is over.  Each
+// participant may review each other participant once per Invite.
+type Review struct {
+	Id       int
+	Invite   int // Invite
+	Reviewer int // Profile
+	Reviewee int // Profile
+	Rating   int
+	Body     string
+	Created  time.Time
+}
+
+// Reputation sums up the Reviews a Profile has received.  Rating is the average, and is
+// zero when there are no Reviews.
+type Reputation struct {
+	Rating  float64
+	Reviews int
+}
+
+// reputationConnector is a connector for getting the Reputations of several Profiles at once.
+type reputationConnector struct {
+	Connector int
+	Reputation
+}
+
+// reputations is the aggregate of every reviewed Profile, to be joined against.
+const reputations = "(select reviewee, avg(rating) as rating, count(*) as reviews from review group by reviewee)"
+
+// over returns when the Invite ended, which is its Start if it never had an End.
+func (i *Invite) over() time.Time {
+	if i.End != nil {
+		return *i.End
+	}
+	return i.Start
+}
+
+// participant reports whether the Profile organized the Invite or accepted it.
+func (i *Invite) participant(id int) bool {
+	if i.Organizer == id {
+		return true
+	}
+	for _, a := range i.Attendees {
+		if a.Id == id && a.Status == StatusAccepted {
+			return true
+		}
+	}
+	return false
+}
+
+// Review saves a Review by reviewer of reviewee for the Invite.  Both must be the
+// organizer or an accepted Attendee of an active Invite which is over, or we return
+// ErrReviewNotAllowed; a second Review of the same pair gets ErrDuplicateReview.
+func (i *Invite) Review(ctx context.Context, reviewer, reviewee, rating int, body string) (*Review, error) {
+	if err := ready(ctx); err != nil {
+		return nil, err
+	}
+	if !i.Active || reviewer == reviewee || !i.participant(reviewer) || !i.participant(reviewee) {
+		return nil, ErrReviewNotAllowed
+	}
+	if time.Now().Before(i.over()) {
+		return nil, ErrInviteNotOver
+	}
+	r := &Review{0, i.Id, reviewer, reviewee, rating, body, time.Now()}
+	err := dbmap.Insert(r)
+	if err != nil {
+		if strings.Index(err.Error(), "violates unique constraint") > -1 {
+			return nil, ErrDuplicateReview
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetReviews returns the Reviews the receiver has received, newest first.
+func (p *Profile) GetReviews(ctx context.Context) ([]Review, error) {
+	if err := ready(ctx); err != nil {
+		return nil, err
+	}
+	rs := []Review{}
+	_, err := dbmap.Select(&rs, "select * from review where reviewee = $1 order by created desc", p.Id)
+	return rs, err
+}
+
+// GetReputations returns the Reputation of each of ids, in one query no matter how
+// many there are.  Profiles nobody has reviewed are present, with zero Reviews.
+func GetReputations(ctx context.Context, ids []int) (map[int]Reputation, error) {
+	out := map[int]Reputation{}
+	ids = uniqueIds(ids)
+	if len(ids) == 0 {
+		return out, nil
+	}
+	if err := ready(ctx); err != nil {
+		return out, err
+	}
+	for _, id := range ids {
+		out[id] = Reputation{}
+	}
+	list, params := inList(nil, ids)
+	rcs := []reputationConnector{}
+	q := "select reviewee as connector, rating, reviews from " + reputations + " as r where reviewee in " + list
+	_, err := dbmap.Select(&rcs, q, params...)
+	if err != nil {
+		return out, err
+	}
+	for _, rc := range rcs {
+		out[rc.Connector] = rc.Reputation
+	}
+	return out, nil
+}
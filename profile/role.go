@@ -0,0 +1,103 @@
+package profile
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Role grants a Profile powers beyond its own data.  Admins can do anything a
+// moderator can.
+type Role string
+
+const (
+	RoleAdmin     Role = "admin"
+	RoleModerator Role = "moderator"
+)
+
+// Roles is the set of Roles a Profile has, stored as a comma-separated list.
+type Roles []Role
+
+var AllRoles map[Role]bool = map[Role]bool{
+	RoleAdmin:     true,
+	RoleModerator: true}
+
+// Has reports whether rs grants r, either directly or because it includes admin.
+func (rs Roles) Has(r Role) bool {
+	for _, have := range rs {
+		if have == r || have == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Scan exists only to convert from the SQL result of a comma-separated list to Roles.
+func (rs *Roles) Scan(src interface{}) error {
+	var list string
+	switch src := src.(type) {
+	default:
+		return errors.New(fmt.Sprintf("unexpected type %T", src))
+	case nil:
+	case string:
+		list = src
+	case []uint8:
+		list = string(src)
+	}
+	*rs = Roles{}
+	for _, r := range strings.Split(list, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			*rs = append(*rs, Role(r))
+		}
+	}
+	return nil
+}
+
+// Value converts Roles back to the comma-separated list we store.
+func (rs Roles) Value() (driver.Value, error) {
+	var list []string
+	for _, r := range rs {
+		list = append(list, string(r))
+	}
+	sort.Strings(list)
+	return strings.Join(list, ","), nil
+}
+
+// SetRoles replaces the Roles of the receiver; any Role not in AllRoles is an error.
+func (p *Profile) SetRoles(ctx context.Context, rs Roles) error {
+	if err := ready(ctx); err != nil {
+		return err
+	}
+	seen := map[Role]bool{}
+	clean := Roles{}
+	for _, r := range rs {
+		if !AllRoles[r] {
+			return ErrUnknownRole
+		}
+		if !seen[r] {
+			seen[r] = true
+			clean = append(clean, r)
+		}
+	}
+	value, _ := clean.Value()
+	_, err := dbmap.Exec("update profile set roles = $1, updated = now() where id = $2", value, p.Id)
+	forgetProfile(p.Id)
+	if err != nil {
+		return err
+	}
+	p.Roles = clean
+	return nil
+}
+
+// GrantRole adds a Role to the Profile with the given id.  This is how the first admin
+// is made, from the command line.
+func GrantRole(ctx context.Context, id int, r Role) error {
+	p, err := GetProfile(ctx, id)
+	if err != nil {
+		return err
+	}
+	return p.SetRoles(ctx, append(p.Roles, r))
+}
@@ -0,0 +1,208 @@
+package profile
+
+import (
+	"sync"
+	"time"
+)
+
+// After a failed login, the next attempt for the same username or from the same address
+// must wait LoginBackoff, doubling with each failure after that, until the limit for
+// the key is reached and it's locked out for LoginLockout.  Addresses are allowed more
+// failures than usernames, since many people may share one.  A key is forgotten once it
+// has gone LoginLockout without a failure.
+//
+// This is kept in memory, like the caches, so each process throttles on its own.
+var (
+	LoginBackoff             = time.Second
+	LoginLockout             = 15 * time.Minute
+	LoginFailuresPerUsername = 5
+	LoginFailuresPerAddress  = 50
+)
+
+// ThrottleKey is a username or address to throttle logins by.
+type ThrottleKey struct {
+	kind  string
+	value string
+}
+
+// UsernameKey throttles logins for a username, whether or not there is an Auth with it.
+func UsernameKey(username string) ThrottleKey {
+	return ThrottleKey{"username", username}
+}
+
+// AddressKey throttles logins from a client address.
+func AddressKey(address string) ThrottleKey {
+	return ThrottleKey{"address", address}
+}
+
+func (k ThrottleKey) allowed() int {
+	if k.kind == "username" {
+		return LoginFailuresPerUsername
+	}
+	return LoginFailuresPerAddress
+}
+
+// throttle is what we know about recent failures for a ThrottleKey.  Attempts under way
+// are pending until they're known to have failed or not, and count against the limit
+// meanwhile, so that a burst of guesses at once can't all get in before the first fails.
+type throttle struct {
+	failures int
+	pending  int
+	last     time.Time
+	until    time.Time
+}
+
+// throttlePruneAt is how many keys we hold before dropping the ones that have expired.
+const throttlePruneAt = 10000
+
+var (
+	throttleLock sync.Mutex
+	throttles    = map[ThrottleKey]*throttle{}
+)
+
+// LoginAttempt is a login under way, which holds its place against the limits for its
+// keys until it's known to have failed or succeeded.
+type LoginAttempt struct {
+	keys []ThrottleKey
+	done bool
+}
+
+// AttemptLogin returns how long it is until a login may be attempted for all of keys.
+// If it may be attempted now, the wait is zero and the attempt is counted against each
+// key until one of the LoginAttempt's methods is called.
+func AttemptLogin(keys ...ThrottleKey) (time.Duration, *LoginAttempt) {
+	now := time.Now()
+	var wait time.Duration
+	throttleLock.Lock()
+	defer throttleLock.Unlock()
+	if len(throttles) >= throttlePruneAt {
+		pruneThrottles(now)
+	}
+	for _, k := range keys {
+		t := throttles[k]
+		if t == nil {
+			continue
+		}
+		if t.pending == 0 && now.Sub(t.last) > LoginLockout {
+			delete(throttles, k)
+			continue
+		}
+		if t.until.After(now) {
+			if w := t.until.Sub(now); w > wait {
+				wait = w
+			}
+		} else if t.failures+t.pending >= k.allowed() && LoginBackoff > wait {
+			// the attempts under way could lock it out, so wait to hear how they went
+			wait = LoginBackoff
+		}
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+	for _, k := range keys {
+		t := throttles[k]
+		if t == nil {
+			t = &throttle{}
+			throttles[k] = t
+		}
+		t.pending++
+	}
+	return 0, &LoginAttempt{keys: keys}
+}
+
+// Failed notes that the attempt failed, for each of its keys, returning whether any of
+// them is now locked out.
+func (a *LoginAttempt) Failed() bool {
+	now := time.Now()
+	locked := false
+	throttleLock.Lock()
+	defer throttleLock.Unlock()
+	if a.done {
+		return false
+	}
+	a.done = true
+	for _, k := range a.keys {
+		t := settle(k)
+		if now.Sub(t.last) > LoginLockout {
+			t.failures = 0
+		}
+		t.failures++
+		t.last = now
+		if t.failures >= k.allowed() {
+			t.until = now.Add(LoginLockout)
+			locked = true
+			continue
+		}
+		backoff := LoginBackoff
+		for i := 1; i < t.failures && backoff < LoginLockout; i++ {
+			backoff *= 2
+		}
+		if backoff > LoginLockout {
+			backoff = LoginLockout
+		}
+		t.until = now.Add(backoff)
+	}
+	return locked
+}
+
+// Succeeded forgets the failures for the attempt's username.  Its address keeps them,
+// so that one account someone knows the password to doesn't reset the count for it.
+func (a *LoginAttempt) Succeeded() {
+	throttleLock.Lock()
+	defer throttleLock.Unlock()
+	if a.done {
+		return
+	}
+	a.done = true
+	for _, k := range a.keys {
+		t := settle(k)
+		if k.kind != "username" {
+			continue
+		}
+		if t.pending == 0 {
+			delete(throttles, k)
+		} else {
+			t.failures = 0
+			t.until = time.Time{}
+		}
+	}
+}
+
+// Release gives up the attempt's place without counting it either way, for when we
+// couldn't tell whether it should have succeeded.  It does nothing once Failed or
+// Succeeded has been called, so it's safe to defer.
+func (a *LoginAttempt) Release() {
+	throttleLock.Lock()
+	defer throttleLock.Unlock()
+	if a.done {
+		return
+	}
+	a.done = true
+	for _, k := range a.keys {
+		settle(k)
+	}
+}
+
+// settle ends one pending attempt for k, returning its throttle.  throttleLock must be
+// held.
+func settle(k ThrottleKey) *throttle {
+	t := throttles[k]
+	if t == nil {
+		t = &throttle{}
+		throttles[k] = t
+	}
+	if t.pending > 0 {
+		t.pending--
+	}
+	return t
+}
+
+// pruneThrottles drops keys which are neither waiting, counting failures nor attempting
+// logins any more.  throttleLock must be held.
+func pruneThrottles(now time.Time) {
+	for k, t := range throttles {
+		if t.pending == 0 && now.After(t.until) && now.Sub(t.last) > LoginLockout {
+			delete(throttles, k)
+		}
+	}
+}
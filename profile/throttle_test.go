@@ -0,0 +1,72 @@
+package profile
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// resetThrottles forgets every key, so that tests don't see each other's failures.
+func resetThrottles() {
+	throttleLock.Lock()
+	defer throttleLock.Unlock()
+	throttles = map[ThrottleKey]*throttle{}
+}
+
+func TestConcurrentFailuresAreThrottled(t *testing.T) {
+	resetThrottles()
+	key := UsernameKey("guessed")
+	var reached int32
+	var wg sync.WaitGroup
+	for j := 0; j < 10*LoginFailuresPerUsername; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, attempt := AttemptLogin(key)
+			if wait > 0 {
+				return
+			}
+			defer attempt.Release()
+			// standing in for Authenticate, which is slow on purpose
+			atomic.AddInt32(&reached, 1)
+			time.Sleep(10 * time.Millisecond)
+			attempt.Failed()
+		}()
+	}
+	wg.Wait()
+	if n := int(atomic.LoadInt32(&reached)); n > LoginFailuresPerUsername {
+		t.Errorf("%d attempts reached Authenticate; want at most %d", n, LoginFailuresPerUsername)
+	}
+	if wait, _ := AttemptLogin(key); wait <= LoginBackoff {
+		t.Errorf("waiting %v after %d failures; want a lockout", wait, LoginFailuresPerUsername)
+	}
+}
+
+func TestSuccessClearsUsernameOnly(t *testing.T) {
+	resetThrottles()
+	user, address := UsernameKey("forgetful"), AddressKey("192.0.2.1")
+	_, attempt := AttemptLogin(user, address)
+	attempt.Failed()
+
+	throttleLock.Lock()
+	throttles[user].until = time.Time{}
+	throttles[address].until = time.Time{}
+	throttleLock.Unlock()
+
+	wait, attempt := AttemptLogin(user, address)
+	if wait > 0 {
+		t.Fatalf("waiting %v once the backoff has passed", wait)
+	}
+	attempt.Succeeded()
+	attempt.Failed()
+
+	throttleLock.Lock()
+	defer throttleLock.Unlock()
+	if throttles[user] != nil {
+		t.Errorf("username still throttled after a successful login")
+	}
+	if a := throttles[address]; a == nil || a.failures != 1 || a.pending != 0 {
+		t.Errorf("address throttle is %+v; want the one failure kept and nothing pending", a)
+	}
+}
@@ -0,0 +1,67 @@
+package profile
+
+import (
+	"context"
+
+	"github.com/coopernurse/gorp"
+)
+
+// Tx is a unit of work: everything done through it is committed or rolled back together.
+// Functions which take a *Tx accept nil to mean no transaction, with each statement
+// standing on its own, as before.
+type Tx struct {
+	tx   *gorp.Transaction
+	done bool
+}
+
+// Begin starts a unit of work.  Every Tx must end with Commit or Rollback.
+func Begin(ctx context.Context) (*Tx, error) {
+	if err := ready(ctx); err != nil {
+		return nil, err
+	}
+	tx, err := dbmap.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx: tx}, nil
+}
+
+// Commit makes everything done through the Tx permanent.
+func (t *Tx) Commit() error {
+	t.done = true
+	return t.tx.Commit()
+}
+
+// Rollback undoes everything done through the Tx.  It does nothing once the Tx has
+// been committed or rolled back, so it's safe to defer.
+func (t *Tx) Rollback() error {
+	if t.done {
+		return nil
+	}
+	t.done = true
+	return t.tx.Rollback()
+}
+
+// InTransaction calls f with a new Tx, committing if it succeeds and rolling back if
+// it returns an error.
+func InTransaction(ctx context.Context, f func(t *Tx) error) error {
+	t, err := Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+	err = f(t)
+	if err != nil {
+		return err
+	}
+	return t.Commit()
+}
+
+// executor returns what to run statements against: the transaction, or for a nil Tx,
+// the database itself.
+func (t *Tx) executor() gorp.SqlExecutor {
+	if t == nil {
+		return dbmap
+	}
+	return t.tx
+}
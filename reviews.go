@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/randallsquared/gochute/profile"
+)
+
+// NewReview is the context Profile's rating of another participant in an Invite.
+type NewReview struct {
+	Reviewee int
+	Rating   int
+	Body     string
+}
+
+func addReview(u *url.URL, h http.Header, r *NewReview, c *Context) (int, http.Header, Response, error) {
+	if r == nil {
+		return error400(h, "no review provided")
+	}
+	if r.Rating < profile.MinRating || r.Rating > profile.MaxRating {
+		complaint := "ratings must be between " + strconv.Itoa(profile.MinRating) + " and " + strconv.Itoa(profile.MaxRating)
+		return errorField(h, "Rating", complaint, "bad rating")
+	}
+	r.Body = strings.TrimSpace(r.Body)
+	if len(r.Body) > 1000 {
+		return errorField(h, "Body", "reviews must be 1000 characters or less", "review too long")
+	}
+	id := param(u, "id")
+	intId, err := strconv.Atoi(id)
+	if err != nil {
+		return error400(h, "'"+id+"' is not a valid Invite Id.", "Bad invite id.")
+	}
+	ii, err := profile.GetInvite(c.Ctx, intId)
+	if err != nil {
+		if errors.Is(err, profile.ErrNotFound) {
+			return error404(h, "Invite not found.", err)
+		}
+		return error500(h, "db failure: r38", err)
+	}
+	ir, err := ii.Review(c.Ctx, c.Profile.Id, r.Reviewee, r.Rating, r.Body)
+	if err != nil {
+		switch {
+		case errors.Is(err, profile.ErrReviewNotAllowed):
+			return error403(h, "only the organizer and accepted attendees of an active invite can review each other", err.Error())
+		case errors.Is(err, profile.ErrInviteNotOver):
+			return error400(h, "reviews can only be left once the invite is over", err.Error())
+		case errors.Is(err, profile.ErrDuplicateReview):
+			return error409(h, "you've already reviewed this profile for this invite", err.Error())
+		}
+		return error500(h, "db failure: r52", err)
+	}
+	return http.StatusCreated, nil, ir, nil
+}
+
+func getReviews(u *url.URL, h http.Header, _ interface{}, c *Context) (int, http.Header, Response, error) {
+	ip, errType, err := findProfile(u, c)
+	if err != nil {
+		return errType(h, "profile not found", err.Error())
+	}
+	rs, err := ip.GetReviews(c.Ctx)
+	if err != nil {
+		return error500(h, "db failure: r64", err)
+	}
+	return http.StatusOK, nil, rs, nil
+}
@@ -1,17 +1,29 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/randallsquared/go-tigertonic"
+	"github.com/randallsquared/gochute/metrics"
 	"github.com/randallsquared/gochute/profile"
 )
 
 var (
 	listen            string = ":1600"
+	metricsListen     string = ""
+	maxUploadBytes    int64  = 64 << 20 // whole request body for photo uploads
+	requestTimeout           = 30 * time.Second
+	shutdownTimeout          = 60 * time.Second
 	mux               *tigertonic.TrieServeMux
 	cors              *tigertonic.CORSBuilder
 	allowedPhotoTypes map[string]bool
@@ -21,56 +33,65 @@ var (
 const (
 	ChuteToken       = "X-chute-token"
 	UsernamelessSalt = "nx7sn3ks67La72&2"
+	maxPhotoMemory   = 32 << 20 // multipart bytes held in memory before spilling to disk
+	maxTravelMiles   = 12500    // halfway around the world
+	requestIdLength  = 20
 )
 
 type Response interface {
 }
 
+// Context's Ctx is done when the client goes away or the request has run for
+// requestTimeout, and should be handed to every profile call.
 type Context struct {
 	Auth    *profile.Auth
 	Profile *profile.Profile
+	Ctx     context.Context
 }
 
-func error400(e string, addl ...interface{}) (int, http.Header, Response, error) {
-	return abort(tigertonic.BadRequest{errors.New(e)}, e, addl)
+// scoped sets the Ctx of the request's Context, with requestTimeout as its deadline if
+// it's limited.  tigertonic finds the Context by request, so the request itself can't be
+// replaced with one carrying the deadline.
+type scoped struct {
+	h       http.Handler
+	limited bool
 }
 
-func error401(e string, addl ...interface{}) (int, http.Header, Response, error) {
-	return abort(tigertonic.Unauthorized{errors.New(e)}, e, addl)
-}
-
-func error403(e string, addl ...interface{}) (int, http.Header, Response, error) {
-	return abort(tigertonic.Forbidden{errors.New(e)}, e, addl)
-}
-
-func error404(e string, addl ...interface{}) (int, http.Header, Response, error) {
-	return abort(tigertonic.NotFound{errors.New(e)}, e, addl)
-}
-
-func error500(e string, addl ...interface{}) (int, http.Header, Response, error) {
-	return abort(tigertonic.InternalServerError{errors.New(e)}, e, addl)
-}
-
-func abort(err error, why string, addl []interface{}) (int, http.Header, Response, error) {
-	logged := []interface{}{}
-	logged = append(logged, why)
-	for _, val := range addl {
-		logged = append(logged, val)
+func (s scoped) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if s.limited {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
 	}
-	log.Println(logged...)
-	return 0, nil, nil, err
+	tigertonic.Context(r).(*Context).Ctx = ctx
+	s.h.ServeHTTP(w, r)
 }
 
 func unauthenticated(h interface{}) http.Handler {
-	return cors.Build(tigertonic.Marshaled(h)) //tigertonic.Logged(tigertonic.Marshaled(h), nil))
+	return cors.Build(scoped{tigertonic.Marshaled(h), true}) //tigertonic.Logged(tigertonic.Marshaled(h), nil))
 }
 
 func authenticated(h interface{}) http.Handler {
-	return cors.Build(tigertonic.If(authenticate, tigertonic.Marshaled(h)))
+	return cors.Build(scoped{guard{authenticate, tigertonic.Marshaled(h)}, true})
 }
 
+// rawAuthenticated handlers stream uploads and downloads which may well take longer than
+// requestTimeout, so they only stop when the client goes away; the profile calls they
+// make are still bounded by their own timeouts.
 func rawAuthenticated(h http.Handler) http.Handler {
-	return cors.Build(tigertonic.If(authenticate, h))
+	return cors.Build(scoped{guard{authenticate, h}, false})
+}
+
+// restricted is authenticated for handlers which also require the Profile to have at
+// least one of the given Roles.
+func restricted(h interface{}, roles ...profile.Role) http.Handler {
+	return cors.Build(scoped{guard{authenticate, guard{requireRoles(roles...), tigertonic.Marshaled(h)}}, true})
+}
+
+// rawRestricted is restricted for handlers which write their own responses.
+func rawRestricted(h http.Handler, roles ...profile.Role) http.Handler {
+	return cors.Build(scoped{guard{authenticate, guard{requireRoles(roles...), h}}, true})
 }
 
 func init() {
@@ -81,39 +102,76 @@ func init() {
 	// set up web handlers
 	cors = tigertonic.NewCORSBuilder()
 	cors.AddAllowedOrigins("*")
-	cors.AddAllowedHeaders("content-type", "cache-control", "pragma", ChuteToken)
-	cors.AddExposedHeaders(ChuteToken)
+	cors.AddAllowedHeaders("content-type", "cache-control", "pragma", "if-none-match", ChuteToken, RequestIdHeader)
+	cors.AddExposedHeaders(ChuteToken, "etag", RequestIdHeader, "Retry-After")
 	mux = tigertonic.NewTrieServeMux()
-	mux.Handle("POST", "/profiles/self", unauthenticated(createProfile))
-	mux.Handle("POST", "/actions/login", unauthenticated(login))
-	mux.Handle("POST", "/actions/logout", authenticated(logout)) // er, why did I build this?
-	mux.Handle("POST", "/auths", authenticated(connectAuth))
-	mux.Handle("GET", "/profiles/self/auths", authenticated(getAuths))
-	mux.Handle("POST", "/profiles/self/auths", authenticated(createAuth))
-	mux.Handle("PUT", "/profiles/self/auths/{id}", authenticated(updateAuth))
-	mux.Handle("GET", "/profiles/{id}", authenticated(getProfile))
-	mux.Handle("GET", "/profiles/self", authenticated(getProfile))
-	mux.Handle("PUT", "/profiles/self", authenticated(updateProfile))
-	mux.Handle("POST", "/profiles/self/photos", rawAuthenticated(PhotoHandler{}))
-	mux.Handle("DELETE", "/profiles/self/photos/{id}", authenticated(removePhoto))
-	mux.Handle("PUT", "/profiles/self/photos/{id}", authenticated(updatePhoto))
-	mux.Handle("POST", "/profiles/self/frees", authenticated(createFreetime))
-	mux.Handle("GET", "/profiles/self/frees", authenticated(getFreetime))
-	mux.Handle("GET", "/profiles/{id}/frees", authenticated(getFreetime))
-	mux.Handle("DELETE", "/profiles/self/frees", authenticated(removeAllFreetime))
-	mux.Handle("DELETE", "/profiles/self/frees/{start}", authenticated(removeFreetime))
-	mux.Handle("GET", "/flags", unauthenticated(getFlags))
-	mux.Handle("GET", "/types", unauthenticated(getTypes))
-	mux.Handle("GET", "/rates", unauthenticated(getRates))
+	// scrapers which can't log in should use -metrics-listen instead
+	mux.Handle("GET", "/metrics", rawRestricted(metrics.Handler(), profile.RoleAdmin))
+	mux.Handle("GET", "/healthz", unauthenticated(getHealth))
+	mux.Handle("GET", "/readyz", unauthenticated(getReady))
+	handle("POST", "/profiles/self", unauthenticated(createProfile))
+	handle("POST", "/actions/login", unauthenticated(login))
+	handle("POST", "/actions/logout", authenticated(logout)) // er, why did I build this?
+	handle("POST", "/auths", authenticated(connectAuth))
+	handle("GET", "/profiles/self/auths", authenticated(getAuths))
+	handle("POST", "/profiles/self/auths", authenticated(createAuth))
+	handle("PUT", "/profiles/self/auths/{id}", authenticated(updateAuth))
+	handle("GET", "/profiles/{id}", authenticated(getProfile))
+	handle("GET", "/profiles/self", authenticated(getProfile))
+	handle("PUT", "/profiles/self", authenticated(updateProfile))
+	handle("DELETE", "/profiles/self", authenticated(deleteProfile))
+	handle("DELETE", "/profiles/self/deletion", authenticated(cancelDeletion))
+	handle("GET", "/profiles/self/export", rawAuthenticated(ExportHandler{}))
+	handle("GET", "/profiles/self/activity", authenticated(getActivity))
+	handle("POST", "/profiles/self/photos", rawAuthenticated(PhotoHandler{}))
+	handle("PUT", "/profiles/self/photos", authenticated(reorderPhotos))
+	handle("DELETE", "/profiles/self/photos/{id}", authenticated(removePhoto))
+	handle("PUT", "/profiles/self/photos/{id}", authenticated(updatePhoto))
+	handle("POST", "/profiles/self/frees", authenticated(createFreetime))
+	handle("GET", "/profiles/self/frees", authenticated(getFreetime))
+	handle("GET", "/profiles/{id}/frees", authenticated(getFreetime))
+	handle("DELETE", "/profiles/self/frees", authenticated(removeAllFreetime))
+	handle("DELETE", "/profiles/self/frees/{start}", authenticated(removeFreetime))
+	handle("GET", "/flags", unauthenticated(getFlags))
+	handle("GET", "/types", unauthenticated(getTypes))
+	handle("GET", "/rates", unauthenticated(getRates))
+	handle("GET", "/attributes", unauthenticated(getAttributes))
+	handle("GET", "/currencies", unauthenticated(getCurrencies))
 	// TODO: need to make sure this doesn't get cached
-	mux.Handle("GET", "/profiles", authenticated(getProfilesBySearch))
-	mux.Handle("POST", "/invites", authenticated(invite))
-	mux.Handle("GET", "/invites/{id}", authenticated(getInvite))
-	mux.Handle("GET", "/profiles/self/invites", authenticated(getMyInvitesBySearch))
-	mux.Handle("POST", "/profiles/self/invites/{id}/status", authenticated(changeStatus))
-	mux.Handle("POST", "/invites/{id}/messages", authenticated(addMessage))
-	mux.Handle("DELETE", "/invites/{id}", authenticated(cancelInvite))
-	mux.Handle("POST", "/invites/{id}/attendees", authenticated(addAttendees))
+	handle("GET", "/profiles", authenticated(getProfilesBySearch))
+	handle("POST", "/invites", authenticated(invite))
+	handle("GET", "/invites/{id}", authenticated(getInvite))
+	handle("GET", "/profiles/self/invites", authenticated(getMyInvitesBySearch))
+	handle("POST", "/profiles/self/invites/{id}/status", authenticated(changeStatus))
+	handle("POST", "/invites/{id}/messages", authenticated(addMessage))
+	handle("DELETE", "/invites/{id}", authenticated(cancelInvite))
+	handle("POST", "/invites/{id}/attendees", authenticated(addAttendees))
+	handle("POST", "/invites/{id}/reviews", authenticated(addReview))
+	handle("GET", "/profiles/{id}/reviews", authenticated(getReviews))
+	handle("GET", "/profiles/self/reviews", authenticated(getReviews))
+	handle("POST", "/reports", authenticated(report))
+	handle("GET", "/moderation/reports", restricted(getReports, profile.RoleModerator))
+	handle("PUT", "/moderation/reports/{id}/assignee", restricted(assignReport, profile.RoleModerator))
+	handle("PUT", "/moderation/reports/{id}/resolution", restricted(resolveReport, profile.RoleModerator))
+	handle("POST", "/moderation/actions", restricted(moderate, profile.RoleModerator))
+	handle("GET", "/moderation/actions", restricted(getModerations, profile.RoleModerator))
+	handle("GET", "/admin/flags", restricted(getAllFlags, profile.RoleAdmin))
+	handle("POST", "/admin/flags", restricted(createFlag, profile.RoleAdmin))
+	handle("PUT", "/admin/flags/{id}", restricted(updateFlag, profile.RoleAdmin))
+	handle("GET", "/admin/types", restricted(getAllTypes, profile.RoleAdmin))
+	handle("POST", "/admin/types", restricted(createType, profile.RoleAdmin))
+	handle("PUT", "/admin/types/{id}", restricted(updateType, profile.RoleAdmin))
+	handle("GET", "/admin/rates", restricted(getAllRates, profile.RoleAdmin))
+	handle("POST", "/admin/rates", restricted(createRate, profile.RoleAdmin))
+	handle("PUT", "/admin/rates", restricted(reorderRates, profile.RoleAdmin))
+	handle("PUT", "/admin/rates/{id}", restricted(updateRate, profile.RoleAdmin))
+	handle("GET", "/admin/attributes", restricted(getAllAttributes, profile.RoleAdmin))
+	handle("POST", "/admin/attributes", restricted(createAttribute, profile.RoleAdmin))
+	handle("PUT", "/admin/attributes/{id}", restricted(updateAttribute, profile.RoleAdmin))
+	handle("GET", "/admin/exchange", restricted(getExchangeRates, profile.RoleAdmin))
+	handle("PUT", "/admin/exchange/{currency}", restricted(setExchangeRate, profile.RoleAdmin))
+	handle("PUT", "/admin/profiles/{id}/roles", restricted(setRoles, profile.RoleAdmin))
+	handle("GET", "/admin/events", restricted(getEvents, profile.RoleAdmin))
 
 	/*
 		       // we don't need this because we're returning signed URLs for the photos.
@@ -125,10 +183,99 @@ func init() {
 }
 
 func main() {
-	handler := tigertonic.WithContext(mux, Context{})
-	server := tigertonic.NewServer(listen, handler)
+	flag.StringVar(&listen, "listen", listen, "address to listen on")
+	flag.StringVar(&metricsListen, "metrics-listen", metricsListen, "private address to also serve metrics on, without logging in")
+	flag.Int64Var(&maxUploadBytes, "max-upload-bytes", maxUploadBytes, "largest photo upload request, in bytes")
+	flag.Int64Var(&profile.MaxPhotoBytes, "max-photo-bytes", profile.MaxPhotoBytes, "largest single photo file, in bytes")
+	flag.IntVar(&profile.MaxPhotoPixels, "max-photo-pixels", profile.MaxPhotoPixels, "largest photo, in total pixels")
+	flag.IntVar(&profile.MaxPhotoEdge, "max-photo-edge", profile.MaxPhotoEdge, "largest photo width or height, in pixels")
+	flag.IntVar(&profile.MaxPhotos, "max-photos", profile.MaxPhotos, "most photos per profile")
+	flag.Int64Var(&profile.MaxPhotoStorage, "max-photo-storage", profile.MaxPhotoStorage, "most stored photo bytes per profile")
+	flag.DurationVar(&profile.CacheTTL, "cache-ttl", profile.CacheTTL, "longest time to trust cached sessions and lookups")
+	flag.DurationVar(&requestTimeout, "request-timeout", requestTimeout, "longest time any request may take")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "longest time to wait for requests in flight when shutting down")
+	flag.DurationVar(&profile.QueryTimeout, "query-timeout", profile.QueryTimeout, "longest time a listing of invites, reports or events may take")
+	flag.DurationVar(&profile.SearchTimeout, "search-timeout", profile.SearchTimeout, "longest time a profile search may take")
+	flag.DurationVar(&profile.StorageTimeout, "storage-timeout", profile.StorageTimeout, "longest time to wait for each request to S3")
+	flag.TextVar(&logLevel, "log-level", &logLevel, "least severe level to log: DEBUG (which includes SQL), INFO, WARN or ERROR")
+	flag.DurationVar(&profile.LoginBackoff, "login-backoff", profile.LoginBackoff, "wait after a failed login, doubling with each further failure")
+	flag.DurationVar(&profile.LoginLockout, "login-lockout", profile.LoginLockout, "how long too many failed logins lock out a username or address")
+	flag.IntVar(&profile.LoginFailuresPerUsername, "login-failures", profile.LoginFailuresPerUsername, "failed logins for a username before it's locked out")
+	flag.IntVar(&profile.LoginFailuresPerAddress, "login-address-failures", profile.LoginFailuresPerAddress, "failed logins from an address before it's locked out")
+	flag.Func("trusted-proxies", "comma separated addresses or CIDR ranges of proxies whose X-Forwarded-For to believe", setTrustedProxies)
+	flag.DurationVar(&profile.DeletionGrace, "deletion-grace", profile.DeletionGrace, "how long deleted profiles wait before being purged")
+	grantAdmin := flag.Int("grant-admin", 0, "give the profile with this id the admin role, and exit")
+	reconcile := flag.Bool("reconcile", false, "compare stored photo files with the database, report, and exit")
+	reconcileFix := flag.Bool("reconcile-fix", false, "with -reconcile, also delete orphaned files and photos with missing files")
+	purgeDeleted := flag.Bool("purge-deleted", false, "purge profiles whose deletion grace period has passed, and exit")
+	flag.Parse()
+	setupLogging()
+	ctx := context.Background()
+
+	if *grantAdmin != 0 {
+		err := profile.GrantRole(ctx, *grantAdmin, profile.RoleAdmin)
+		if err != nil {
+			log.Fatalln("grant-admin failed:", err.Error())
+		}
+		fmt.Println("profile", *grantAdmin, "is now an admin")
+		return
+	}
+
+	if *reconcile {
+		report, err := profile.Reconcile(ctx, *reconcileFix)
+		if err != nil {
+			log.Fatalln("reconcile failed:", err.Error())
+		}
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	if *purgeDeleted {
+		n, err := profile.PurgeDeleted(ctx)
+		fmt.Println("purged", n, "profiles")
+		if err != nil {
+			log.Fatalln("purge-deleted failed:", err.Error())
+		}
+		return
+	}
+
+	if metricsListen != "" {
+		go func() {
+			err := http.ListenAndServe(metricsListen, metrics.Handler())
+			log.Fatalln("metrics server failed:", err.Error())
+		}()
+	}
+	handler := logged{tigertonic.WithContext(mux, Context{})}
+	server := &http.Server{Addr: listen, Handler: handler}
+	drained := make(chan struct{})
+	go drain(server, drained)
 	err := server.ListenAndServe()
-	if nil != err {
-		fmt.Println("ERROR!")
+	if err != http.ErrServerClosed {
+		log.Fatalln("server failed:", err.Error())
+	}
+	<-drained
+	err = profile.Close()
+	if err != nil {
+		slog.Error("couldn't close the database", "error", err)
+	}
+	slog.Info("stopped")
+}
+
+// drain waits for SIGTERM or an interrupt, then stops accepting connections and waits
+// up to shutdownTimeout for requests in flight, such as uploads, before cutting them off.
+// It closes drained when no more requests are being handled.
+func drain(server *http.Server, drained chan struct{}) {
+	defer close(drained)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	slog.Info("shutting down", "signal", sig.String(), "timeout", shutdownTimeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		slog.Warn("cutting off requests still in flight", "error", err)
+		server.Close()
 	}
 }